@@ -0,0 +1,173 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains functions for the proxy to keep a copy of each message it relays.
+
+// Envelope describes a message relayed by the proxy
+type Envelope struct {
+	MailFrom   string    // reverse path, without angle brackets. Empty for a null sender
+	RcptTo     []string  // recipients accepted by the upstream, without angle brackets
+	ClientAddr string    // address of the client that sent the message
+	Upstream   string    // host:port of the upstream server the message was relayed to
+	Code       int       // upstream response to the message
+	Msg        string    // upstream response text, including any enhanced status code
+	Time       time.Time // when the upstream responded
+}
+
+// MessageArchiver receives a copy of each message the proxy relays, once the upstream has responded to it,
+// whether or not the message was accepted. Errors are logged, and don't affect the response to the client.
+type MessageArchiver interface {
+	Archive(env *Envelope, msg io.Reader) error
+}
+
+// writeEnvelopeHeaders records the envelope as header fields, to go at the top of an archived message
+func writeEnvelopeHeaders(w io.Writer, env *Envelope, eol string) {
+	fmt.Fprintf(w, "Return-Path: <%s>%s", headerSafe(env.MailFrom), eol)
+	for _, rcpt := range env.RcptTo {
+		fmt.Fprintf(w, "X-Envelope-To: <%s>%s", headerSafe(rcpt), eol)
+	}
+	if env.ClientAddr != "" {
+		fmt.Fprintf(w, "X-Proxy-Client: %s%s", headerSafe(env.ClientAddr), eol)
+	}
+	if env.Upstream != "" {
+		fmt.Fprintf(w, "X-Proxy-Upstream: %s%s", headerSafe(env.Upstream), eol)
+	}
+	fmt.Fprintf(w, "X-Proxy-Response: %d %s%s", env.Code, headerSafe(env.Msg), eol)
+	fmt.Fprintf(w, "X-Proxy-Date: %s%s", env.Time.Format(time.RFC1123Z), eol)
+}
+
+// headerSafe flattens a value onto one line, e.g. a multi-line upstream response
+func headerSafe(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+}
+
+// MaildirArchiver stores each message as a file in the "new" subdirectory of a Maildir, with the envelope
+// added as header fields: Return-Path, X-Envelope-To for each recipient, and X-Proxy-Client, X-Proxy-Upstream,
+// X-Proxy-Response and X-Proxy-Date. Each file is a complete message, with LF line endings as usual for Maildir.
+type MaildirArchiver struct {
+	Dir      string
+	hostname string
+}
+
+// NewMaildirArchiver creates a MaildirArchiver, creating the Maildir if necessary
+func NewMaildirArchiver(dir string) (*MaildirArchiver, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	hostname, _ := os.Hostname()
+	// The Maildir spec reserves / and : in file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	return &MaildirArchiver{Dir: dir, hostname: hostname}, nil
+}
+
+// Archive writes the message to the Maildir's tmp directory, then moves it into new, so readers of the
+// Maildir only ever see complete messages
+func (a *MaildirArchiver) Archive(env *Envelope, msg io.Reader) error {
+	name := fmt.Sprintf("%d.%s.%s", env.Time.Unix(), newQueueID(), a.hostname)
+	tmp := filepath.Join(a.Dir, "tmp", name)
+	_, err := writeFileSync(tmp, func(w io.Writer) error {
+		writeEnvelopeHeaders(w, env, "\n")
+		return copyLF(w, msg)
+	})
+	if err == nil {
+		err = renameSync(tmp, filepath.Join(a.Dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// copyLF copies a message from r to w, with LF line endings whichever the message arrived with
+func copyLF(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.HasSuffix(line, "\r\n") {
+			line = line[:len(line)-2] + "\n"
+		}
+		bw.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// MboxArchiver appends each message to an mbox file, in mboxrd format, with LF line endings. The envelope is
+// added as header fields, as for MaildirArchiver.
+type MboxArchiver struct {
+	Filename string
+	locker   sync.Mutex
+}
+
+// NewMboxArchiver creates an MboxArchiver appending to filename, which is created if necessary
+func NewMboxArchiver(filename string) *MboxArchiver {
+	return &MboxArchiver{Filename: filename}
+}
+
+// Archive appends the message to the mbox file. Lines beginning "From ", after any number of ">", are quoted
+// with a further ">".
+func (a *MboxArchiver) Archive(env *Envelope, msg io.Reader) error {
+	var b bytes.Buffer
+	from := env.MailFrom
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	// The From line is space separated, so the sender can't contain spaces
+	fmt.Fprintf(&b, "From %s %s\n", strings.Replace(headerSafe(from), " ", "_", -1), env.Time.UTC().Format(time.ANSIC))
+	writeEnvelopeHeaders(&b, env, "\n")
+	br := bufio.NewReader(msg)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				b.WriteByte('>')
+			}
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	b.WriteByte('\n') // messages are separated by a blank line
+
+	// Write each message in one go, so that messages from concurrent sessions don't interleave
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	f, err := os.OpenFile(a.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = b.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
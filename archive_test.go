@@ -0,0 +1,85 @@
+package smtpproxy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+var testEnvelope = &smtpproxy.Envelope{
+	MailFrom:   "sender@example.com",
+	RcptTo:     []string{"a@example.com", "b@example.com"},
+	ClientAddr: "192.0.2.1:12345",
+	Upstream:   "smtp.example.com:587",
+	Code:       250,
+	Msg:        "2.0.0 OK\nqueued",
+	Time:       time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+}
+
+func TestMaildirArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := smtpproxy.NewMaildirArchiver(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Archive(testEnvelope, strings.NewReader("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one message in new, got %v %v", files, err)
+	}
+	got, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Return-Path: <sender@example.com>\n" +
+		"X-Envelope-To: <a@example.com>\n" +
+		"X-Envelope-To: <b@example.com>\n" +
+		"X-Proxy-Client: 192.0.2.1:12345\n" +
+		"X-Proxy-Upstream: smtp.example.com:587\n" +
+		"X-Proxy-Response: 250 2.0.0 OK queued\n" +
+		"X-Proxy-Date: Wed, 04 Mar 2020 05:06:07 +0000\n" +
+		"Subject: test\n\nHello\n"
+	if string(got) != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+}
+
+func TestMboxArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := smtpproxy.NewMboxArchiver(filepath.Join(dir, "archive.mbox"))
+	for _, body := range []string{"Subject: one\r\n\r\nFrom here\r\n>From there\r\n", "Subject: two\r\n\r\nBye"} {
+		if err := a.Archive(testEnvelope, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ioutil.ReadFile(a.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(got), "From sender@example.com Wed Mar  4 05:06:07 2020\n"); n != 2 {
+		t.Errorf("Got %d From lines, expected 2", n)
+	}
+	for _, s := range []string{"X-Envelope-To: <b@example.com>\n", "\n>From here\n>>From there\n\n", "Subject: two\n\nBye\n\n"} {
+		if !strings.Contains(string(got), s) {
+			t.Errorf("Expected %q in %q", s, got)
+		}
+	}
+	if strings.Contains(string(got), "\r") {
+		t.Error("Expected LF line endings")
+	}
+}
@@ -0,0 +1,151 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This file contains functions for the proxy to authenticate downstream clients itself,
+// and choose which credentials to present to the upstream server on their behalf.
+
+// ErrAuthFailed is returned by the built-in Authenticators when credentials are not valid
+var ErrAuthFailed = errors.New("smtp: authentication failed")
+
+// Authenticator checks the credentials presented by a downstream client
+type Authenticator interface {
+	// Authenticate returns nil if the username and password are valid
+	Authenticate(username, password string) error
+}
+
+// AuthenticatorFunc allows an ordinary function to be used as an Authenticator
+type AuthenticatorFunc func(username, password string) error
+
+// Authenticate calls f(username, password)
+func (f AuthenticatorFunc) Authenticate(username, password string) error {
+	return f(username, password)
+}
+
+// PasswordFile is an Authenticator holding htpasswd-style "username:password" entries.
+// Passwords may be bcrypt hashes (as made by htpasswd -B) or plaintext.
+type PasswordFile struct {
+	users map[string]string
+}
+
+// LoadPasswordFile reads a PasswordFile from disk
+func LoadPasswordFile(filename string) (*PasswordFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPasswordFile(f)
+}
+
+// ReadPasswordFile reads "username:password" lines. Blank lines and lines starting with # are ignored
+func ReadPasswordFile(r io.Reader) (*PasswordFile, error) {
+	pf := &PasswordFile{users: make(map[string]string)}
+	err := readColonFile(r, 2, func(fields []string) {
+		pf.users[fields[0]] = fields[1]
+	})
+	return pf, err
+}
+
+// Authenticate checks the password against the stored entry
+func (pf *PasswordFile) Authenticate(username, password string) error {
+	stored, ok := pf.users[username]
+	if !ok {
+		return ErrAuthFailed
+	}
+	if isBcrypt(stored) {
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return ErrAuthFailed
+		}
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func isBcrypt(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// Credentials to present to the upstream server
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsFunc chooses the upstream credentials for an authenticated downstream user.
+// Returning nil Credentials means no AUTH is sent upstream.
+type CredentialsFunc func(username string) (*Credentials, error)
+
+// StaticCredentials returns a CredentialsFunc presenting the same upstream credentials for every user
+func StaticCredentials(username, password string) CredentialsFunc {
+	return func(string) (*Credentials, error) {
+		return &Credentials{Username: username, Password: password}, nil
+	}
+}
+
+// CredentialsMap returns a CredentialsFunc choosing upstream credentials by downstream username.
+// Users not in the map get def, which may be nil.
+func CredentialsMap(m map[string]Credentials, def *Credentials) CredentialsFunc {
+	return func(username string) (*Credentials, error) {
+		if cred, ok := m[username]; ok {
+			return &cred, nil
+		}
+		return def, nil
+	}
+}
+
+// LoadCredentialsFile reads "downstreamuser:upstreamuser:upstreampassword" lines into a CredentialsFunc.
+// A downstream username of * sets the default for users not otherwise listed.
+func LoadCredentialsFile(filename string) (CredentialsFunc, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]Credentials)
+	var def *Credentials
+	err = readColonFile(f, 3, func(fields []string) {
+		cred := Credentials{Username: fields[1], Password: fields[2]}
+		if fields[0] == "*" {
+			def = &cred
+		} else {
+			m[fields[0]] = cred
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CredentialsMap(m, def), nil
+}
+
+// readColonFile calls fn with each line of r split into n colon-separated fields. The last
+// field takes the rest of the line, so may itself contain colons.
+func readColonFile(r io.Reader, n int, fn func(fields []string)) error {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", n)
+		if len(fields) != n {
+			return fmt.Errorf("line %d: expected %d colon-separated fields", lineNum, n)
+		}
+		fn(fields)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,70 @@
+package smtpproxy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwFile := "# test users\n" +
+		"alice:" + string(hash) + "\n" +
+		"\n" +
+		"bob:pass:with:colons\n"
+	pf, err := smtpproxy.ReadPasswordFile(strings.NewReader(pwFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type userPassResult struct {
+		user, pass string
+		ok         bool
+	}
+	for _, v := range []userPassResult{
+		{"alice", "s3cret", true},
+		{"alice", "wrong", false},
+		{"bob", "pass:with:colons", true},
+		{"bob", "pass", false},
+		{"carol", "", false},
+	} {
+		if err := pf.Authenticate(v.user, v.pass); (err == nil) != v.ok {
+			t.Errorf("Authenticate(%s, %s) returned %v, expected ok=%v", v.user, v.pass, err, v.ok)
+		}
+	}
+
+	if _, err := smtpproxy.ReadPasswordFile(strings.NewReader("nocolon\n")); err == nil {
+		t.Error("Expected error for malformed line")
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	f, err := ioutil.TempFile(".", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice:upstream-alice:key1\n*:upstream-default:key2\n")
+	f.Close()
+
+	creds, err := smtpproxy.LoadCredentialsFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, expected := range map[string]smtpproxy.Credentials{
+		"alice": {Username: "upstream-alice", Password: "key1"},
+		"bob":   {Username: "upstream-default", Password: "key2"},
+	} {
+		c, err := creds(user)
+		if err != nil || c == nil || *c != expected {
+			t.Errorf("Credentials for %s: got %v %v, expected %v", user, c, err, expected)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package smtpproxy
 
 import (
+	"context"
 	"io"
 )
 
@@ -11,6 +12,26 @@ type Backend interface {
 	Init() (Session, error)
 }
 
+// ContextBackend is implemented by backends that tie each session to the life of its downstream connection.
+// Servers call InitContext in preference to Init. ctx is cancelled when the connection closes, when the server
+// is closed, or when a graceful shutdown runs out of time, so the session can abandon blocked upstream work.
+type ContextBackend interface {
+	Backend
+	InitContext(ctx context.Context, state ConnectionState) (Session, error)
+}
+
+// Command is an SMTP command, split into the command verb and its argument
+type Command struct {
+	Cmd string
+	Arg string
+}
+
+// Response is an SMTP response code and message
+type Response struct {
+	Code int
+	Msg  string
+}
+
 // SessionFunc Session backend functions
 type SessionFunc func(expectcode int, cmd, arg string) (int, string, error)
 
@@ -39,6 +60,32 @@ type Session interface {
 	// Data body (dot delimited) pass upstream, returning the usual responses
 	Data(r io.Reader, w io.WriteCloser) (int, string, error)
 
+	// Bdat passes a BDAT chunk (RFC 3030 CHUNKING) of size bytes upstream, returning the usual responses.
+	// last is set on the final chunk of the message.
+	Bdat(size int64, last bool, r io.Reader) (int, string, error)
+
 	// This is called if we see any unknown command
 	Unknown(expectcode int, cmd, arg string) (int, string, error)
 }
+
+// LMTPSession is implemented by sessions that can report the outcome of the message data for each recipient,
+// as an LMTP server must (RFC 2033). For other sessions, the single Data response is repeated for each recipient.
+type LMTPSession interface {
+	Session
+	// LMTPResponses returns one response per accepted recipient, for the message just passed to Data or Bdat
+	LMTPResponses() []Response
+}
+
+// PipelineSession is implemented by sessions that can pass a group of pipelined commands
+// (MAIL, RCPT, RSET) upstream together, as per RFC 2920. It returns one response per command, in order.
+type PipelineSession interface {
+	Session
+	Pipeline(cmds []Command) []Response
+}
+
+// StateSession is implemented by sessions that follow changes to the downstream connection. SetState is called
+// with the new state before each Greet, and after STARTTLS.
+type StateSession interface {
+	Session
+	SetState(state ConnectionState)
+}
@@ -0,0 +1,66 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CapsPolicy rewrites the EHLO capabilities about to be advertised to a downstream client,
+// returning the list to actually advertise. It is called once per EHLO.
+type CapsPolicy func(state ConnectionState, caps []string) []string
+
+// capKeyword returns the EHLO keyword of a capability, e.g. "AUTH" from "AUTH LOGIN PLAIN"
+func capKeyword(cap string) string {
+	if i := strings.IndexAny(cap, " ="); i >= 0 {
+		cap = cap[:i]
+	}
+	return strings.ToUpper(cap)
+}
+
+// RemoveCaps returns a CapsPolicy that strips the given EHLO keywords, e.g. "CHUNKING"
+func RemoveCaps(keywords ...string) CapsPolicy {
+	return func(state ConnectionState, caps []string) []string {
+		out := []string{}
+	nextCap:
+		for _, cap := range caps {
+			for _, k := range keywords {
+				if capKeyword(cap) == strings.ToUpper(k) {
+					continue nextCap
+				}
+			}
+			out = append(out, cap)
+		}
+		return out
+	}
+}
+
+// LimitSize returns a CapsPolicy that advertises a SIZE no greater than max bytes,
+// adding SIZE if the upstream didn't declare a limit
+func LimitSize(max int64) CapsPolicy {
+	return func(state ConnectionState, caps []string) []string {
+		limit := max
+		out := []string{}
+		for _, cap := range caps {
+			if capKeyword(cap) == "SIZE" {
+				// SIZE with no parameter, or zero, means no fixed limit
+				if n, err := strconv.ParseInt(strings.TrimSpace(cap[len("SIZE"):]), 10, 64); err == nil && n > 0 && n < limit {
+					limit = n
+				}
+				continue
+			}
+			out = append(out, cap)
+		}
+		return append(out, "SIZE "+strconv.FormatInt(limit, 10))
+	}
+}
+
+// ChainCapsPolicies returns a CapsPolicy that applies each of the policies in turn
+func ChainCapsPolicies(policies ...CapsPolicy) CapsPolicy {
+	return func(state ConnectionState, caps []string) []string {
+		for _, p := range policies {
+			caps = p(state, caps)
+		}
+		return caps
+	}
+}
@@ -0,0 +1,29 @@
+package smtpproxy_test
+
+import (
+	"reflect"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+func TestCapsPolicies(t *testing.T) {
+	upstream := []string{"8BITMIME", "AUTH LOGIN PLAIN", "CHUNKING", "ENHANCEDSTATUSCODES", "SIZE 52428800", "SMTPUTF8"}
+	var state smtpproxy.ConnectionState
+
+	policyExpected := []struct {
+		policy smtpproxy.CapsPolicy
+		caps   []string
+	}{
+		{smtpproxy.RemoveCaps("chunking", "AUTH"), []string{"8BITMIME", "ENHANCEDSTATUSCODES", "SIZE 52428800", "SMTPUTF8"}},
+		{smtpproxy.LimitSize(1000), []string{"8BITMIME", "AUTH LOGIN PLAIN", "CHUNKING", "ENHANCEDSTATUSCODES", "SMTPUTF8", "SIZE 1000"}},
+		{smtpproxy.LimitSize(100000000), []string{"8BITMIME", "AUTH LOGIN PLAIN", "CHUNKING", "ENHANCEDSTATUSCODES", "SMTPUTF8", "SIZE 52428800"}},
+		{smtpproxy.ChainCapsPolicies(smtpproxy.RemoveCaps("SIZE", "SMTPUTF8"), smtpproxy.LimitSize(2000)), []string{"8BITMIME", "AUTH LOGIN PLAIN", "CHUNKING", "ENHANCEDSTATUSCODES", "SIZE 2000"}},
+	}
+	for _, v := range policyExpected {
+		caps := v.policy(state, upstream)
+		if !reflect.DeepEqual(caps, v.caps) {
+			t.Errorf("Got caps %v, expected %v", caps, v.caps)
+		}
+	}
+}
@@ -6,13 +6,18 @@
 package smtpproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // A Client represents a client connection to an SMTP server. Stripped out unused functionality for proxy
@@ -20,6 +25,8 @@ type Client struct {
 	Text             *textproto.Conn // Text is the textproto.Conn used by the Client. It is exported to allow for clients to add extensions.
 	conn             net.Conn        // keep a reference to the connection so it can be used to create a TLS connection later
 	tls              bool            // whether the Client is using TLS
+	lmtp             bool            // whether the Client speaks LMTP rather than SMTP
+	rcpts            int             // recipients accepted in the current transaction, needed to read LMTP data responses
 	serverName       string
 	ext              map[string]string // map of supported extensions
 	localName        string            // the name to use in HELO/EHLO/LHLO
@@ -29,56 +36,189 @@ type Client struct {
 	helloErr         error             // Error form of the above
 	DataResponseCode int               // proxy error reporting for data phase (as writeCloser can only return "error" class)
 	DataResponseMsg  string
+	DataResponses    []Response    // LMTP only: the data phase response for each recipient
+	stopWatch        func()        // stops watching the context the Client was dialled with
+	created          time.Time     // when the connection was made
+	messages         int           // messages sent on this connection
+	authedAs         string        // the username given to a successful Auth
+	greeting         string        // the server's 220 greeting
+	tapIn, tapOut    *switchWriter // copies of what is received and sent, for a session transcript
+
+	// AllowInsecureAuth lets Auth send credentials to a remote server without TLS
+	AllowInsecureAuth bool
 }
 
 // Dial returns a new Client connected to an SMTP server at addr.
 // The addr must include a port, as in "mail.example.com:smtp".
 func Dial(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but ctx bounds both the connection attempt and the life of the Client.
+// If ctx is cancelled, the connection is closed, abandoning any command in progress.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	host, _, _ := net.SplitHostPort(addr)
-	return NewClient(conn, host)
+	return newClientContext(ctx, conn, host)
 }
 
 // DialTLS returns a new Client connected to an SMTP server via TLS at addr.
 // The addr must include a port, as in "mail.example.com:smtps".
 func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	return DialTLSContext(context.Background(), addr, tlsConfig)
+}
+
+// DialTLSContext is like DialTLS, but with a context as for DialContext.
+func DialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (*Client, error) {
+	d := tls.Dialer{Config: tlsConfig}
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	host, _, _ := net.SplitHostPort(addr)
-	return NewClient(conn, host)
+	return newClientContext(ctx, conn, host)
+}
+
+// DialLMTP returns a new Client speaking LMTP (RFC 2033) to a server at addr.
+// If addr starts with "/", it is the path of a Unix socket, otherwise it must include a port.
+func DialLMTP(addr string) (*Client, error) {
+	return DialLMTPContext(context.Background(), addr)
+}
+
+// DialLMTPContext is like DialLMTP, but with a context as for DialContext.
+func DialLMTPContext(ctx context.Context, addr string) (*Client, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := newClientContext(ctx, conn, host)
+	if err != nil {
+		return nil, err
+	}
+	c.lmtp = true
+	return c, nil
+}
+
+// newClientContext is NewClient, with the connection closed if ctx is cancelled before the Client is
+func newClientContext(ctx context.Context, conn net.Conn, host string) (*Client, error) {
+	stop := closeOnCancel(ctx, conn)
+	c, err := NewClient(conn, host)
+	if err != nil {
+		stop()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c.stopWatch = stop
+	return c, nil
+}
+
+// closeOnCancel closes conn if ctx is cancelled before the returned stop function is called
+func closeOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {} // never cancelled
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
 }
 
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn, host string) (*Client, error) {
-	text := textproto.NewConn(conn)
-	_, _, err := text.ReadResponse(220)
+	_, isTLS := conn.(*tls.Conn)
+	c := &Client{conn: conn, serverName: host, localName: "localhost", tls: isTLS, created: time.Now()}
+	c.Text = c.newText()
+	_, msg, err := c.Text.ReadResponse(220)
 	if err != nil {
-		text.Close()
+		c.Text.Close()
 		return nil, err
 	}
-	_, isTLS := conn.(*tls.Conn)
-	c := &Client{Text: text, conn: conn, serverName: host, localName: "localhost", tls: isTLS}
+	c.greeting = msg
 	return c, nil
 }
 
+// newText returns the textproto.Conn for the connection, copying what passes to the taps
+func (c *Client) newText() *textproto.Conn {
+	if c.tapIn == nil {
+		c.tapIn, c.tapOut = &switchWriter{}, &switchWriter{}
+	}
+	return textproto.NewConn(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{
+		io.TeeReader(c.conn, c.tapIn),
+		io.MultiWriter(c.conn, c.tapOut),
+		c.conn,
+	})
+}
+
+// setTranscript records the conversation from now on in t, or stops recording it if t is nil
+func (c *Client) setTranscript(t *Transcript) {
+	if c.tapIn == nil {
+		return // Text was given to us
+	}
+	if t == nil {
+		c.tapIn.set(nil)
+		c.tapOut.set(nil)
+		return
+	}
+	t.upstream.reset()
+	c.tapIn.set(t.upstream.resps)
+	c.tapOut.set(t.upstream.cmds)
+}
+
+// watch closes the connection if ctx is cancelled, in place of any context given when dialling
+func (c *Client) watch(ctx context.Context) {
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	c.stopWatch = closeOnCancel(ctx, c.conn)
+}
+
 // Close closes the connection.
 func (c *Client) Close() error {
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
 	return c.Text.Close()
 }
 
+// Quit sends the QUIT command and closes the connection, whatever the response
+func (c *Client) Quit() (int, string, error) {
+	code, msg, err := c.cmd(221, "QUIT")
+	c.Close()
+	return code, msg, err
+}
+
 // hello runs a hello exchange if needed.
 func (c *Client) hello() (int, string, error) {
 	if !c.didHello {
 		c.didHello = true
 		// Try Extended hello first
 		c.helloCode, c.helloMsg, c.helloErr = c.ehlo()
-		if c.helloErr != nil {
+		if c.helloErr != nil && !c.lmtp {
 			// Didn't succeed, try a basic hello
 			c.helloCode, c.helloMsg, c.helloErr = c.helo()
 		}
@@ -104,16 +244,67 @@ func (c *Client) Hello(localName string) (int, string, error) {
 
 // cmd is a convenience function that sends a command and returns the response
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	id, err := c.Text.Cmd(format, args...)
+	line := fmt.Sprintf(format, args...)
+	id, err := c.Text.Cmd("%s", line)
 	if err != nil {
 		return 0, "", err
 	}
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
 	code, msg, err := c.Text.ReadResponse(expectCode)
+	c.countRcpts(line, code)
 	return code, msg, err
 }
 
+// countRcpts keeps count of the recipients accepted in the current transaction
+func (c *Client) countRcpts(line string, code int) {
+	verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+	switch verb {
+	case "RCPT":
+		if code2xxSuccess(code) {
+			c.rcpts++
+		}
+	case "MAIL", "RSET", "HELO", "EHLO", "LHLO":
+		c.rcpts = 0
+	}
+}
+
+// Pipeline sends a group of command lines without waiting for each response, as per RFC 2920 PIPELINING,
+// then collects the responses in order. On a connection error, the responses received so far are returned.
+func (c *Client) Pipeline(lines []string) ([]Response, error) {
+	for _, line := range lines {
+		if err := validateLine(line); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]uint, len(lines))
+	for i, line := range lines {
+		ids[i] = c.Text.Next()
+		c.Text.StartRequest(ids[i])
+		c.Text.W.WriteString(line + "\r\n")
+		c.Text.EndRequest(ids[i])
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		return nil, err
+	}
+
+	resps := []Response{}
+	var err error
+	for _, id := range ids {
+		c.Text.StartResponse(id)
+		if err == nil {
+			var code int
+			var msg string
+			if code, msg, err = c.Text.ReadResponse(0); err == nil {
+				resps = append(resps, Response{Code: code, Msg: msg})
+				c.countRcpts(lines[len(resps)-1], code)
+			}
+		}
+		c.Text.EndResponse(id) // keep the pipeline sequence moving, even after an error
+	}
+	return resps, err
+}
+
 // MyCmd - is a wrapper for underlying method
 func (c *Client) MyCmd(expectCode int, format string, args ...interface{}) (int, string, error) {
 	return c.cmd(expectCode, format, args...)
@@ -131,6 +322,9 @@ func (c *Client) helo() (int, string, error) {
 // Now returns code, msg, error for transparency.
 func (c *Client) ehlo() (int, string, error) {
 	cmd := "EHLO"
+	if c.lmtp {
+		cmd = "LHLO"
+	}
 	code, msg, err := c.cmd(250, "%s %s", cmd, c.localName)
 	if err == nil {
 		ext := make(map[string]string)
@@ -169,8 +363,13 @@ func (c *Client) StartTLS(config *tls.Config) (int, string, error) {
 	if testHookStartTLS != nil {
 		testHookStartTLS(config)
 	}
-	c.conn = tls.Client(c.conn, config)
-	c.Text = textproto.NewConn(c.conn)
+	// Handshake now, so certificate errors are reported here rather than by the next command
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return 0, err.Error(), err
+	}
+	c.conn = tlsConn
+	c.Text = c.newText()
 	c.tls = true
 	c.didHello = false // Important to pass internal checks before next EHLO
 	return code, msg, err
@@ -187,6 +386,56 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// Auth authenticates to the server with the given credentials, using AUTH PLAIN if the server
+// offers it, otherwise AUTH LOGIN. As both send the password in the clear, Auth refuses unless the
+// connection is using TLS, is to this host, or AllowInsecureAuth is set.
+func (c *Client) Auth(username, password string) (int, string, error) {
+	if err := validateLine(username + password); err != nil {
+		return 501, err.Error(), err
+	}
+	if !c.tls && !c.AllowInsecureAuth && !c.isLocal() {
+		err := errors.New("smtp: refusing to send credentials without TLS")
+		return 530, err.Error(), err
+	}
+	code, msg, err := c.auth(username, password)
+	if err == nil {
+		c.authedAs = username
+	}
+	return code, msg, err
+}
+
+// isLocal reports whether the server is on this host, so credentials sent to it stay here
+func (c *Client) isLocal() bool {
+	if c.conn != nil && c.conn.RemoteAddr().Network() == "unix" {
+		return true
+	}
+	switch c.serverName {
+	case "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+func (c *Client) auth(username, password string) (int, string, error) {
+	_, mechs := c.Extension("AUTH")
+	mechs = " " + strings.ToUpper(mechs) + " "
+	switch {
+	case strings.Contains(mechs, " PLAIN "):
+		resp := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+		return c.cmd(235, "AUTH PLAIN %s", resp)
+	case strings.Contains(mechs, " LOGIN "):
+		if code, msg, err := c.cmd(334, "AUTH LOGIN"); err != nil {
+			return code, msg, err
+		}
+		if code, msg, err := c.cmd(334, "%s", base64.StdEncoding.EncodeToString([]byte(username))); err != nil {
+			return code, msg, err
+		}
+		return c.cmd(235, "%s", base64.StdEncoding.EncodeToString([]byte(password)))
+	}
+	err := errors.New("smtp: server doesn't support AUTH PLAIN or LOGIN")
+	return 504, err.Error(), err
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
@@ -197,9 +446,17 @@ type dataCloser struct {
 func (d *dataCloser) Close() error {
 	d.WriteCloser.Close()
 	// Pass the extended response info back via Client structure.
-	code, msg, err := d.c.Text.ReadResponse(250)
+	var code int
+	var msg string
+	var err error
+	if d.c.lmtp {
+		code, msg, err = d.c.readLMTPResponses()
+	} else {
+		code, msg, err = d.c.Text.ReadResponse(250)
+	}
 	d.c.DataResponseCode = code
 	d.c.DataResponseMsg = msg
+	d.c.messages++
 	return err
 }
 
@@ -215,6 +472,56 @@ func (c *Client) Data() (io.WriteCloser, int, string, error) {
 	return &dataCloser{c, c.Text.DotWriter()}, code, msg, err
 }
 
+// Bdat sends a BDAT command (RFC 3030 CHUNKING) followed by size bytes of message data read from r.
+// Set last on the final chunk of the message.
+func (c *Client) Bdat(size int64, last bool, r io.Reader) (int, string, error) {
+	cmd := fmt.Sprintf("BDAT %d", size)
+	if last {
+		cmd += " LAST"
+	}
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	c.Text.W.WriteString(cmd + "\r\n")
+	_, err := io.CopyN(c.Text.W, r, size)
+	if err == nil {
+		err = c.Text.W.Flush()
+	}
+	c.Text.EndRequest(id)
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	if err != nil {
+		return 0, "", err
+	}
+	if last {
+		c.messages++
+	}
+	if c.lmtp && last {
+		return c.readLMTPResponses()
+	}
+	return c.Text.ReadResponse(250)
+}
+
+// readLMTPResponses reads the response for each recipient at the end of the message data. They are kept in
+// DataResponses, and summarised as the first failure, if any, otherwise the last success.
+func (c *Client) readLMTPResponses() (int, string, error) {
+	c.DataResponses = []Response{}
+	var code int
+	var msg string
+	var err error
+	for i := 0; i < c.rcpts; i++ {
+		rcode, rmsg, rerr := c.Text.ReadResponse(250)
+		if rcode == 0 {
+			return rcode, rmsg, rerr // connection error, there's no more to read
+		}
+		c.DataResponses = append(c.DataResponses, Response{Code: rcode, Msg: rmsg})
+		if err == nil {
+			code, msg, err = rcode, rmsg, rerr
+		}
+	}
+	c.rcpts = 0
+	return code, msg, err
+}
+
 var testHookStartTLS func(*tls.Config) // nil, except for tests
 
 // Extension reports whether an extension is support by the server.
@@ -0,0 +1,150 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// This file contains functions for the proxy to reuse upstream connections across downstream sessions.
+
+// ClientPool keeps idle upstream connections, already greeted, secured and authenticated, for later sessions to
+// reuse. Connections are kept per upstream host:port and upstream username. Zero limits mean no limit, so a
+// zero ClientPool is ready to use, without limits.
+type ClientPool struct {
+	MaxIdle     int           // idle connections kept per upstream and username
+	IdleTimeout time.Duration // how long a connection may sit idle
+	MaxAge      time.Duration // how long a connection may be used for, from when it was made
+	MaxMessages int           // messages sent on a connection before it's retired
+
+	locker sync.Mutex
+	idle   map[string][]idleClient // by upstream host:port, most recently used last
+}
+
+type idleClient struct {
+	c     *Client
+	since time.Time
+}
+
+// NewClientPool creates an empty pool, with default limits
+func NewClientPool() *ClientPool {
+	return &ClientPool{
+		MaxIdle:     4,
+		IdleTimeout: 30 * time.Second,
+		MaxAge:      5 * time.Minute,
+		MaxMessages: 100,
+		idle:        make(map[string][]idleClient),
+	}
+}
+
+// Get returns an idle connection to addr, authenticated as authedAs (or not authenticated, if empty), or nil
+// if there isn't one. The connection is checked with RSET before it's returned, and is then closed if ctx is
+// cancelled.
+func (p *ClientPool) Get(ctx context.Context, addr, authedAs string) *Client {
+	return p.get(ctx, addr, func(a string) bool { return a == authedAs })
+}
+
+// get returns an idle connection to addr whose username satisfies match
+func (p *ClientPool) get(ctx context.Context, addr string, match func(authedAs string) bool) *Client {
+	for {
+		p.locker.Lock()
+		list := p.idle[addr]
+		// Most recently used first, as it's the least likely to have been timed out by the upstream
+		i := len(list) - 1
+		for i >= 0 && !match(list[i].c.authedAs) {
+			i--
+		}
+		if i < 0 {
+			p.locker.Unlock()
+			return nil
+		}
+		ic := list[i]
+		p.idle[addr] = append(list[:i:i], list[i+1:]...)
+		p.locker.Unlock()
+
+		if p.expired(ic, time.Now()) {
+			ic.c.Close()
+			continue
+		}
+		ic.c.watch(ctx)
+		if _, _, err := ic.c.cmd(250, "RSET"); err != nil {
+			ic.c.Close()
+			continue
+		}
+		return ic.c
+	}
+}
+
+// Put offers a connection for reuse. It's kept if within the pool's limits, and otherwise closed.
+// The connection must be idle, i.e. not part way through a mail transaction or other command.
+func (p *ClientPool) Put(addr string, c *Client) {
+	now := time.Now()
+	if p.MaxMessages > 0 && c.messages >= p.MaxMessages || p.MaxAge > 0 && now.Sub(c.created) >= p.MaxAge {
+		c.Quit()
+		return
+	}
+	if c.stopWatch != nil {
+		c.stopWatch() // no longer tied to the session that used it
+	}
+	p.locker.Lock()
+	if p.idle == nil {
+		p.idle = make(map[string][]idleClient) // pool made without NewClientPool
+	}
+	expired := p.sweep(now)
+	n := 0
+	for _, ic := range p.idle[addr] {
+		if ic.c.authedAs == c.authedAs {
+			n++
+		}
+	}
+	full := p.MaxIdle > 0 && n >= p.MaxIdle
+	if !full {
+		p.idle[addr] = append(p.idle[addr], idleClient{c: c, since: now})
+	}
+	p.locker.Unlock()
+	for _, ec := range expired {
+		ec.Close() // the upstream may have given up on it already
+	}
+	if full {
+		c.Quit()
+	}
+}
+
+// Close closes all idle connections
+func (p *ClientPool) Close() {
+	p.locker.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]idleClient)
+	p.locker.Unlock()
+	for _, list := range idle {
+		for _, ic := range list {
+			ic.c.Quit()
+		}
+	}
+}
+
+func (p *ClientPool) expired(ic idleClient, now time.Time) bool {
+	return p.IdleTimeout > 0 && now.Sub(ic.since) >= p.IdleTimeout || p.MaxAge > 0 && now.Sub(ic.c.created) >= p.MaxAge
+}
+
+// sweep removes expired connections, returning them to be closed. Call with locker held
+func (p *ClientPool) sweep(now time.Time) []*Client {
+	var expired []*Client
+	for addr, list := range p.idle {
+		kept := list[:0]
+		for _, ic := range list {
+			if p.expired(ic, now) {
+				expired = append(expired, ic.c)
+			} else {
+				kept = append(kept, ic)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, addr)
+		} else {
+			p.idle[addr] = kept
+		}
+	}
+	return expired
+}
@@ -2,11 +2,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tuck1s/go-smtpproxy"
 	"gopkg.in/natefinch/lumberjack.v2" // timed rotating log handler
@@ -25,14 +32,48 @@ func myLogger(filename string) {
 }
 
 func main() {
+	archiveMaildir := flag.String("archive_maildir", "", "Maildir to keep a copy of each message relayed in, with its envelope and upstream response")
+	archiveMbox := flag.String("archive_mbox", "", "mbox file to keep a copy of each message relayed in, with its envelope and upstream response")
 	inHostPort := flag.String("in_hostport", "localhost:587", "Port number to serve incoming SMTP requests")
-	outHostPort := flag.String("out_hostport", "smtp.sparkpostmail.com:587", "host:port for onward routing of SMTP requests")
+	outHostPort := flag.String("out_hostport", "smtp.sparkpostmail.com:587", "host:port for onward routing of SMTP requests. Give a comma-separated list of host:port[/priority[/weight]] to fail over between several, in order by default")
 	certfile := flag.String("certfile", "", "Certificate file for this server")
 	privkeyfile := flag.String("privkeyfile", "", "Private key file for this server")
 	logfile := flag.String("logfile", "", "File written with message logs (also to stdout)")
 	verboseOpt := flag.Bool("verbose", false, "print out lots of messages")
-	downstreamDebug := flag.String("downstream_debug", "", "File to write downstream server SMTP conversation for debugging")
+	downstreamDebug := flag.String("downstream_debug", "", "File to write the transcript of each session to as it ends, with each line tagged with the session ID, for debugging")
 	insecureSkipVerify := flag.Bool("insecure_skip_verify", false, "Skip check of peer cert on upstream side")
+	inTLS := flag.Bool("in_tls", false, "Serve clients with implicit TLS (SMTPS), rather than plaintext with optional STARTTLS. Requires certfile and privkeyfile")
+	outTLS := flag.String("out_tls", "mirror", "Upstream TLS: mirror (STARTTLS when the client does), plain, starttls (always) or implicit (SMTPS)")
+	inLMTP := flag.Bool("in_lmtp", false, "Serve LMTP to clients, on a Unix socket given by in_hostport")
+	outLMTP := flag.Bool("out_lmtp", false, "Speak LMTP upstream. out_hostport may be a Unix socket path")
+	authDisabled := flag.Bool("auth_disabled", false, "Do not offer or accept AUTH from clients")
+	authRequireTLS := flag.Bool("auth_require_tls", false, "Only offer and accept AUTH from clients once the connection is using TLS")
+	authMechanisms := flag.String("auth_mechanisms", "", "Comma-separated list of AUTH mechanisms offered to clients, e.g. PLAIN,LOGIN (default: as offered upstream)")
+	authFile := flag.String("auth_file", "", "htpasswd-style file of username:password (bcrypt or plaintext). If set, the proxy authenticates clients itself")
+	upstreamInsecureAuth := flag.Bool("upstream_insecure_auth", false, "Allow the credentials from upstream_auth_file to be sent to a remote upstream without TLS")
+	upstreamAuthFile := flag.String("upstream_auth_file", "", "File of clientuser:upstreamuser:upstreampassword lines, choosing the credentials used upstream for clients authenticated via auth_file. Use * for the default")
+	helloName := flag.String("hello_name", "", "Name to give in EHLO to upstream servers (default: this server's domain with out_mx, otherwise the upstream's own name)")
+	outMX := flag.Bool("out_mx", false, "Deliver direct to the MX hosts of each recipient domain, on port 25, instead of out_hostport. Upstream STARTTLS is used when offered, without checking the certificate, unless out_tls is plain. With out_tls starttls, it's required and checked")
+	domainRouteFile := flag.String("domain_route_file", "", "File of \"pattern host:port[,host:port...]\" lines choosing the upstream by recipient domain, e.g. *.corp.example.com relay.corp.example.com:25. Patterns may be exact, wildcard or /regex/, and prefixed with from: to match the sender domain. Use * for the default route, and reject as host:port to refuse mail")
+	routeFile := flag.String("route_file", "", "File of \"subnet host:port\" lines choosing the upstream by client address, e.g. 10.1.0.0/16 smtp.example.com:587. Use * for the default route, and reject as host:port to refuse clients (default: out_hostport for all)")
+	poolMaxIdle := flag.Int("pool_max_idle", 0, "Idle upstream connections to keep for reuse, per upstream and identity. 0 disables reuse")
+	poolIdleTimeout := flag.Duration("pool_idle_timeout", 30*time.Second, "How long an upstream connection may be kept idle for reuse")
+	poolMaxAge := flag.Duration("pool_max_age", 5*time.Minute, "How long an upstream connection may be reused for")
+	poolMaxMessages := flag.Int("pool_max_messages", 100, "Messages sent on an upstream connection before it's retired")
+	queueDir := flag.String("queue_dir", "", "Directory to queue messages in. If set, messages are acknowledged once stored, and delivered upstream in the background with retries")
+	queueMaxAge := flag.Duration("queue_max_age", 5*24*time.Hour, "How long to keep retrying a queued message before returning it to the sender")
+	dkimDir := flag.String("dkim_dir", "", "Directory of DKIM private keys, named selector._domainkey.domain.pem. If set, messages are signed with the keys for their From domain")
+	metricsListen := flag.String("metrics_listen", "", "host:port to serve Prometheus metrics on, at /metrics")
+	trackingURL := flag.String("tracking_url", "", "Base URL for open and click tracking, e.g. https://track.example.com/t. If set, links in HTML parts are rewritten to go through it, and a tracking pixel is added")
+	trackingKey := flag.String("tracking_key", "", "Secret used to sign tracking links, so only links made by the proxy are redirected")
+	trackingListen := flag.String("tracking_listen", "", "host:port to serve tracking links on, logging each open and click. Requires tracking_key")
+	transcriptDir := flag.String("transcript_dir", "", "Directory to write a transcript of each session to, covering the client and upstream connections, with AUTH exchanges redacted")
+	transcriptMaxData := flag.Int("transcript_max_data", 0, "Bytes of each message to include in transcripts. 0 includes the whole message")
+	receivedHeader := flag.Bool("received_header", false, "Add a Received header to each message, with the client's HELO name and address, TLS cipher, protocol and the transaction ID")
+	maxHops := flag.Int("max_hops", 0, "Reject messages with more Received headers than this, as looping. RFC 5321 suggests at least 100. 0 disables the check")
+	txnIDHeader := flag.Bool("txn_id_header", false, "Add an X-Proxy-Transaction-ID header to each message, with the transaction ID shown in logs")
+	txnLog := flag.String("txn_log", "", "File to append a JSON line to for each mail transaction, with its client, envelope, responses, upstream queue ID and timing. Use - for stdout")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 60*time.Second, "Time allowed for messages in flight to complete on SIGINT / SIGTERM")
 	flag.Usage = func() {
 		const helpText = "SMTP proxy that accepts incoming messages from your downstream client, and relays on to an upstream server.\n" +
 			"Usage of %s:\n"
@@ -70,21 +111,216 @@ func main() {
 			log.Fatal(err)
 		} else {
 			defer dbgFile.Close()
-			log.Println("Proxy logging SMTP commands, responses and downstream DATA to", dbgFile.Name())
+			log.Println("Proxy logging session transcripts to", dbgFile.Name())
 		}
 	}
 
-	s, _, err := smtpproxy.CreateProxy(*inHostPort, *outHostPort, *verboseOpt, cert, privkey, *insecureSkipVerify, dbgFile)
+	upstreamTLS, ok := map[string]smtpproxy.UpstreamTLS{
+		"mirror":   smtpproxy.UpstreamMirrorTLS,
+		"plain":    smtpproxy.UpstreamPlain,
+		"starttls": smtpproxy.UpstreamStartTLS,
+		"implicit": smtpproxy.UpstreamImplicitTLS,
+	}[*outTLS]
+	if !ok {
+		log.Fatalf("Unknown out_tls option %s", *outTLS)
+	}
+
+	upstreams, err := smtpproxy.ParseUpstreams(*outHostPort)
 	if err != nil {
 		log.Fatal(err)
 	}
+	s, be, err := smtpproxy.CreateProxy(*inHostPort, upstreams[0].HostPort, *verboseOpt, cert, privkey, *insecureSkipVerify, dbgFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(upstreams) > 1 {
+		be.SetUpstreams(smtpproxy.NewUpstreamPool(upstreams))
+	}
+	be.SetUpstreamTLS(upstreamTLS)
+	be.SetUpstreamLMTP(*outLMTP)
+	s.LMTP = *inLMTP
+	if *authFile != "" {
+		authenticator, err := smtpproxy.LoadPasswordFile(*authFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var creds smtpproxy.CredentialsFunc
+		if *upstreamAuthFile != "" {
+			if creds, err = smtpproxy.LoadCredentialsFile(*upstreamAuthFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		be.SetLocalAuth(authenticator, creds)
+		be.SetUpstreamInsecureAuth(*upstreamInsecureAuth)
+		log.Println("Authenticating clients locally from", *authFile)
+	}
+	if *helloName == "" && *outMX {
+		*helloName = s.Domain
+	}
+	if *helloName != "" {
+		be.SetHelloName(*helloName)
+	}
+	if *outMX {
+		be.SetRecipientRouter(smtpproxy.MXRouter(nil, "25"))
+		log.Println("Delivering direct to recipient domain MX hosts, as", *helloName)
+	}
+	if *domainRouteFile != "" {
+		router, err := smtpproxy.LoadDomainRoutes(*domainRouteFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.SetRecipientRouter(router)
+		log.Println("Routing mail to upstream servers by domain from", *domainRouteFile)
+	}
+	if *routeFile != "" {
+		router, err := smtpproxy.LoadSubnetRoutes(*routeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.SetRouter(router)
+		log.Println("Routing clients to upstream servers by subnet from", *routeFile)
+	}
+	if *poolMaxIdle > 0 {
+		pool := smtpproxy.NewClientPool()
+		pool.MaxIdle = *poolMaxIdle
+		pool.IdleTimeout = *poolIdleTimeout
+		pool.MaxAge = *poolMaxAge
+		pool.MaxMessages = *poolMaxMessages
+		be.SetClientPool(pool)
+		defer pool.Close()
+		log.Println("Reusing upstream connections, keeping up to", *poolMaxIdle, "idle")
+	}
+	if *archiveMaildir != "" {
+		archiver, err := smtpproxy.NewMaildirArchiver(*archiveMaildir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.SetArchiver(archiver)
+		log.Println("Archiving messages to Maildir", *archiveMaildir)
+	} else if *archiveMbox != "" {
+		be.SetArchiver(smtpproxy.NewMboxArchiver(*archiveMbox))
+		log.Println("Archiving messages to mbox", *archiveMbox)
+	}
+	if *metricsListen != "" {
+		m := smtpproxy.NewMetrics()
+		s.Metrics = m
+		be.SetMetrics(m)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsListen, mux))
+		}()
+		log.Println("Serving metrics on", *metricsListen, "at /metrics")
+	}
+	if *trackingURL != "" {
+		var key []byte
+		if *trackingKey != "" {
+			key = []byte(*trackingKey)
+		}
+		tracker := smtpproxy.NewTracker(*trackingURL, key)
+		be.SetFilters(tracker)
+		log.Println("Tracking opens and clicks via", *trackingURL)
+		if *trackingListen != "" {
+			if key == nil {
+				log.Fatal("tracking_listen needs tracking_key, so that only links made by the proxy are redirected")
+			}
+			sink := smtpproxy.TrackingSinkFunc(func(ev *smtpproxy.TrackingEvent) {
+				b, _ := json.Marshal(ev)
+				log.Println("Tracking event", string(b))
+			})
+			go func() {
+				log.Fatal(http.ListenAndServe(*trackingListen, tracker.Handler(sink)))
+			}()
+			log.Println("Serving tracking links on", *trackingListen)
+		}
+	}
+	if *transcriptDir != "" || *transcriptMaxData > 0 {
+		s.Transcripts = &smtpproxy.TranscriptRecorder{MaxData: *transcriptMaxData}
+		if *transcriptDir != "" {
+			sink, err := smtpproxy.NewTranscriptDir(*transcriptDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.Transcripts.Sink = sink
+			log.Println("Writing session transcripts to", *transcriptDir)
+		}
+	}
+	if *receivedHeader || *txnIDHeader || *maxHops > 0 {
+		be.SetTraceHeaders(&smtpproxy.TraceHeaders{Domain: s.Domain, Received: *receivedHeader, TransactionID: *txnIDHeader, MaxHops: *maxHops})
+		if *receivedHeader || *txnIDHeader {
+			log.Println("Adding trace headers to messages")
+		}
+		if *maxHops > 0 {
+			log.Println("Rejecting messages with more than", *maxHops, "Received headers")
+		}
+	}
+	if *txnLog != "" {
+		w := os.Stdout
+		if *txnLog != "-" {
+			w, err = os.OpenFile(*txnLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer w.Close()
+		}
+		be.SetTransactionLogger(smtpproxy.NewJSONLogger(w))
+		log.Println("Logging transactions to", w.Name())
+	}
+	if *dkimDir != "" {
+		signer, err := smtpproxy.LoadDKIMKeys(*dkimDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.SetDKIMSigner(signer)
+		log.Println("DKIM signing messages with keys from", *dkimDir)
+	}
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	if *queueDir != "" {
+		q, err := smtpproxy.NewQueue(*queueDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		q.MaxAge = *queueMaxAge
+		be.SetQueue(q)
+		go q.Run(queueCtx, be.Deliver)
+		log.Println("Queueing messages in", *queueDir, ", holding", q.Len(), "from before")
+	}
+	s.AuthDisabled = *authDisabled
+	s.AllowInsecureAuth = !*authRequireTLS
+	if *authMechanisms != "" {
+		s.AuthMechanisms = strings.Split(*authMechanisms, ",")
+	}
 
 	log.Println("Proxy will advertise itself as", s.Domain)
 	log.Println("Verbose SMTP conversation logging:", *verboseOpt)
 	log.Println("insecure_skip_verify (Skip check of peer cert on upstream side):", *insecureSkipVerify)
+	log.Println("Implicit TLS for clients:", *inTLS, ", upstream TLS:", *outTLS)
+
+	// On SIGINT / SIGTERM, let messages in flight complete before exiting
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Println("Received", <-sig, "- shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println("Shutdown:", err)
+			s.Close()
+		}
+		stopQueue() // anything part way through delivery is retried on restart
+		close(stopped)
+	}()
 
 	// Begin serving requests
-	if err := s.ListenAndServe(); err != nil {
+	if *inTLS {
+		err = s.ListenAndServeTLS()
+	} else {
+		err = s.ListenAndServe()
+	}
+	if err != smtpproxy.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
 }
@@ -2,6 +2,7 @@
 package smtpproxy
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net"
 	"net/textproto"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,28 +18,49 @@ import (
 
 // ConnectionState gives useful info about the incoming connection, including the TLS status
 type ConnectionState struct {
-	Hostname   string
-	LocalAddr  net.Addr
-	RemoteAddr net.Addr
-	TLS        tls.ConnectionState
+	Hostname    string
+	HeloCommand string // HELO, EHLO or LHLO, whichever the client greeted with
+	LocalAddr   net.Addr
+	RemoteAddr  net.Addr
+	TLS         tls.ConnectionState
+	SessionID   string // identifies the connection in logs
 }
 
 // Conn is the incoming connection
 type Conn struct {
-	conn      net.Conn
-	text      *textproto.Conn
-	server    *Server
-	helo      string
-	nbrErrors int
-	session   Session
-	locker    sync.Mutex
+	id         string      // session ID, given on accept
+	transcript *Transcript // if recording one
+	conn       net.Conn
+	text       *textproto.Conn
+	server     *Server
+	helo       string
+	heloCmd    string
+	caps       []string // capabilities advertised to this client on the last EHLO
+	rcpts      int      // recipients accepted in the current transaction, for LMTP data responses
+	nbrErrors  int
+	session    Session
+	inTxn      bool // a mail transaction is in progress, guarded by locker
+	locker     sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
-func newConn(c net.Conn, s *Server) *Conn {
+func newConn(c net.Conn, s *Server, ctx context.Context) *Conn {
 	sc := &Conn{
+		id:     newQueueID(),
 		server: s,
 		conn:   c,
 	}
+	if s.Transcripts != nil || s.Debug != nil {
+		maxData := 0
+		if s.Transcripts != nil {
+			maxData = s.Transcripts.MaxData
+		}
+		sc.transcript = newTranscript(maxData)
+		sc.transcript.note("Session %s from %v to %v", sc.id, c.RemoteAddr(), c.LocalAddr())
+		ctx = withTranscript(ctx, sc.transcript)
+	}
+	sc.ctx, sc.cancel = context.WithCancel(ctx)
 
 	sc.init()
 	return sc
@@ -45,20 +68,38 @@ func newConn(c net.Conn, s *Server) *Conn {
 
 func (c *Conn) init() {
 	var rwc io.ReadWriteCloser = c.conn
-	if c.server.Debug != nil {
+	if c.transcript != nil {
 		rwc = struct {
 			io.Reader
 			io.Writer
 			io.Closer
 		}{
-			io.TeeReader(c.conn, c.server.Debug),
-			io.MultiWriter(c.conn, c.server.Debug),
+			io.TeeReader(c.conn, c.transcript.client.cmds),
+			io.MultiWriter(c.conn, c.transcript.client.resps),
 			c.conn,
 		}
 	}
 	c.text = textproto.NewConn(rwc)
 }
 
+// endTranscript passes the session's transcript to the server's recorder, and the Debug writer with each line
+// tagged with the session ID
+func (c *Conn) endTranscript() {
+	if c.transcript == nil {
+		return
+	}
+	c.transcript.note("Session %s closed", c.id)
+	b := c.transcript.Bytes()
+	if rec := c.server.Transcripts; rec != nil && rec.Sink != nil {
+		if err := rec.Sink.WriteTranscript(c.id, b); err != nil {
+			c.server.ErrorLog.Printf("transcript error for session %s: %v", c.id, err)
+		}
+	}
+	if c.server.Debug != nil {
+		c.server.Debug.Write(prefixLines(b, c.id+" "))
+	}
+}
+
 // Commands are dispatched to the appropriate handler functions.
 func (c *Conn) handle(cmd string, arg string) {
 	// If panic happens during command handling - send 421 response
@@ -79,9 +120,23 @@ func (c *Conn) handle(cmd string, arg string) {
 	}
 
 	cmd = strings.ToUpper(cmd)
+	if ps, ok := c.Session().(PipelineSession); ok && isPipelinable(cmd) && c.text.R.Buffered() > 0 {
+		c.handlePipeline(ps, cmd, arg)
+		return
+	}
 	switch cmd {
 	case "HELO", "EHLO":
+		if c.server.LMTP {
+			c.WriteResponse(500, EnhancedCode{5, 5, 1}, "This is a LMTP server, use LHLO")
+			return
+		}
 		c.handleHelo(cmd, arg) // Pass in cmd as could be either
+	case "LHLO":
+		if !c.server.LMTP {
+			c.WriteResponse(500, EnhancedCode{5, 5, 1}, "This is not a LMTP server")
+			return
+		}
+		c.handleHelo(cmd, arg)
 	case "AUTH":
 		c.handleAuth(arg)
 	case "MAIL":
@@ -92,6 +147,8 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.handleReset()
 	case "DATA":
 		c.handleData(arg)
+	case "BDAT":
+		c.handleBdat(arg)
 	case "STARTTLS":
 		c.handleStartTLS()
 	case "QUIT":
@@ -107,6 +164,11 @@ func (c *Conn) Server() *Server {
 	return c.server
 }
 
+// ID of this connection, unique to the session
+func (c *Conn) ID() string {
+	return c.id
+}
+
 // Session associated with this connection
 func (c *Conn) Session() Session {
 	c.locker.Lock()
@@ -121,9 +183,58 @@ func (c *Conn) SetSession(session Session) {
 	c.session = session
 }
 
-// Close this connection
+// Close this connection, cancelling its context
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	c.cancel()
+	c.locker.Lock()
+	conn := c.conn
+	c.locker.Unlock()
+	return conn.Close()
+}
+
+// Context of this connection. It is cancelled when the connection is closed, or the server is
+// closed or runs out of time to shut down.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// inTransaction reports whether a mail transaction (MAIL through to end of DATA) is in progress
+func (c *Conn) inTransaction() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.inTxn
+}
+
+// setTransaction marks a mail transaction as started or finished. On starting, any deadline set by wakeIfIdle
+// before the transaction was seen is cleared, so the rest of the transaction can be read.
+func (c *Conn) setTransaction(inTxn bool) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if inTxn && !c.inTxn {
+		var t time.Time
+		if c.server.ReadTimeout != 0 {
+			t = time.Now().Add(c.server.ReadTimeout)
+		}
+		c.conn.SetReadDeadline(t)
+	}
+	c.inTxn = inTxn
+}
+
+// wakeIfIdle interrupts a pending read if no transaction is in progress
+func (c *Conn) wakeIfIdle() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if !c.inTxn {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// quitSession sends QUIT upstream, if the session hasn't already done so
+func (c *Conn) quitSession() {
+	if s := c.Session(); s != nil {
+		s.Quit(0, "QUIT", "")
+		c.SetSession(nil)
+	}
 }
 
 // TLSConnectionState returns the connection's TLS connection state.
@@ -145,8 +256,10 @@ func (c *Conn) State() ConnectionState {
 	}
 
 	state.Hostname = c.helo
+	state.HeloCommand = c.heloCmd
 	state.LocalAddr = c.conn.LocalAddr()
 	state.RemoteAddr = c.conn.RemoteAddr()
+	state.SessionID = c.id
 
 	return state
 }
@@ -159,10 +272,6 @@ func code3xxIntermediate(code int) bool {
 	return (code >= 300) && (code <= 399)
 }
 
-func code5xxPermFail(code int) bool {
-	return (code >= 500) && (code <= 559)
-}
-
 // Change the downstream (client) connection, and upstream connection (via backend) to TLS
 func (c *Conn) handleStartTLS() {
 	if _, isTLS := c.TLSConnectionState(); isTLS {
@@ -180,11 +289,23 @@ func (c *Conn) handleStartTLS() {
 	// Change downstream to TLS
 	var tlsConn *tls.Conn
 	tlsConn = tls.Server(c.conn, c.server.TLSConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		c.WriteResponse(550, EnhancedCode{5, 0, 0}, "Handshake error")
+	err = tlsConn.Handshake()
+	c.server.Metrics.tls("downstream", err)
+	if err != nil {
+		// There's no telling what state the client's TLS is in, so it can't be answered
+		c.server.ErrorLog.Printf("TLS handshake error from %v: %v", c.conn.RemoteAddr(), err)
+		c.transcript.note("TLS handshake with client failed: %v", err)
+		c.Close()
+		return
 	}
+	c.locker.Lock()
 	c.conn = tlsConn
+	c.locker.Unlock()
 	c.init()
+	c.transcript.note("Started %s with client", tls.VersionName(tlsConn.ConnectionState().Version))
+	if ss, ok := c.Session().(StateSession); ok {
+		ss.SetState(c.State())
+	}
 }
 
 // WriteResponse back to the incoming connection.
@@ -228,7 +349,11 @@ func (c *Conn) ReadLine() (string, error) {
 }
 
 func (c *Conn) greet() {
-	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v ESMTP Service Ready", c.server.Domain))
+	protocol := "ESMTP"
+	if c.server.LMTP {
+		protocol = "LMTP"
+	}
+	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v %s Service Ready", c.server.Domain, protocol))
 }
 
 //-----------------------------------------------------------------------------
@@ -243,15 +368,31 @@ func (c *Conn) handleHelo(cmd, arg string) {
 		return
 	}
 	c.helo = domain
+	c.heloCmd = cmd
+	c.setTransaction(false)
+	c.rcpts = 0
 
 	// If no existing session, establish one
 	if c.Session() == nil {
-		s, err := c.server.Backend.Init()
+		var s Session
+		var err error
+		if cb, ok := c.server.Backend.(ContextBackend); ok {
+			s, err = cb.InitContext(c.ctx, c.State())
+		} else {
+			s, err = c.server.Backend.Init()
+		}
 		if err != nil {
-			c.WriteResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			} else {
+				c.WriteResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
+			}
 			return
 		}
-		c.session = s
+		c.SetSession(s)
+	}
+	if ss, ok := c.Session().(StateSession); ok {
+		ss.SetState(c.State())
 	}
 	// Pass greeting to the backend, updating our server capabilities to mirror them
 	upstreamCaps, code, msg, err := c.Session().Greet(cmd)
@@ -259,28 +400,105 @@ func (c *Conn) handleHelo(cmd, arg string) {
 		c.WriteResponse(code, EnhancedCode{4, 0, 0}, msg)
 		return
 	}
-	if len(upstreamCaps) > 0 {
-		c.server.caps = []string{}
-		for _, i := range upstreamCaps {
-			if i == "STARTTLS" {
-				// Offer STARTTLS to the downstream client, but only if our TLS is configured
-				// and downstream not already in TLS
-				if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig == nil || isTLS {
-					continue
-				}
-			}
-			c.server.caps = append(c.server.caps, i)
-		}
-	}
 	if cmd == "HELO" {
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
+		return
 	}
+	c.caps = c.advertisedCaps(upstreamCaps)
 	args := []string{"Hello " + domain}
-	args = append(args, c.server.caps...)
+	args = append(args, c.caps...)
 	c.WriteResponse(250, NoEnhancedCode, args...)
 }
 
+// advertisedCaps works out the capabilities to offer this client, based on those of the upstream
+func (c *Conn) advertisedCaps(upstreamCaps []string) []string {
+	if len(upstreamCaps) == 0 {
+		upstreamCaps = c.server.caps
+	}
+	caps := []string{}
+	for _, i := range upstreamCaps {
+		if i == "STARTTLS" {
+			// Offer STARTTLS to the downstream client, but only if our TLS is configured
+			// and downstream not already in TLS
+			if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig == nil || isTLS {
+				continue
+			}
+		}
+		if capKeyword(i) == "AUTH" {
+			var ok bool
+			if i, ok = c.authCap(i); !ok {
+				continue
+			}
+		}
+		caps = append(caps, i)
+	}
+	if c.server.CapsPolicy != nil {
+		caps = c.server.CapsPolicy(c.State(), caps)
+	}
+	return caps
+}
+
+// Caps returns the capabilities advertised to this client in response to its last EHLO
+func (c *Conn) Caps() []string {
+	return c.caps
+}
+
+// authAllowed reports whether this client may use AUTH in its current state
+func (c *Conn) authAllowed() bool {
+	if c.server.AuthDisabled {
+		return false
+	}
+	_, isTLS := c.TLSConnectionState()
+	return isTLS || c.server.AllowInsecureAuth
+}
+
+// mechanismAllowed reports whether the server policy permits the SASL mechanism
+func (c *Conn) mechanismAllowed(mech string) bool {
+	if len(c.server.AuthMechanisms) == 0 {
+		return true
+	}
+	for _, m := range c.server.AuthMechanisms {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// authCap filters an upstream AUTH capability down to what the client may be offered.
+// Returns false if AUTH should not be advertised at all.
+func (c *Conn) authCap(cap string) (string, bool) {
+	if !c.authAllowed() || len(cap) <= len("AUTH") {
+		return "", false
+	}
+	// Allow for the obsolete "AUTH=LOGIN PLAIN" form
+	sep := cap[len("AUTH") : len("AUTH")+1]
+	mechs := []string{}
+	for _, m := range strings.Fields(cap[len("AUTH")+1:]) {
+		if c.mechanismAllowed(m) {
+			mechs = append(mechs, m)
+		}
+	}
+	if len(mechs) == 0 {
+		return "", false
+	}
+	return "AUTH" + sep + strings.Join(mechs, " "), true
+}
+
 func (c *Conn) handleAuth(arg string) {
+	if !c.authAllowed() {
+		if c.server.AuthDisabled {
+			c.WriteResponse(500, EnhancedCode{5, 5, 2}, "Syntax error, AUTH command unrecognized")
+		} else {
+			c.WriteResponse(530, EnhancedCode{5, 7, 0}, "Must issue a STARTTLS command first")
+		}
+		return
+	}
+	mech := strings.ToUpper(strings.SplitN(arg, " ", 2)[0])
+	if !c.mechanismAllowed(mech) {
+		c.WriteResponse(504, EnhancedCode{5, 5, 4}, "Unrecognized authentication type")
+		return
+	}
 	if s := c.Session(); s != nil {
 		c.handlePassthru("AUTH", arg, s.Auth)
 	}
@@ -288,13 +506,20 @@ func (c *Conn) handleAuth(arg string) {
 
 func (c *Conn) handleMail(arg string) {
 	if s := c.Session(); s != nil {
-		c.handlePassthru("MAIL", arg, s.Mail)
+		c.rcpts = 0
+		// Busy from now on, so a shutdown doesn't interrupt the transaction while MAIL is upstream
+		inTxn := c.inTransaction()
+		c.setTransaction(true)
+		code := c.handlePassthru("MAIL", arg, s.Mail)
+		c.setTransaction(inTxn || code2xxSuccess(code))
 	}
 }
 
 func (c *Conn) handleRcpt(arg string) {
 	if s := c.Session(); s != nil {
-		c.handlePassthru("RCPT", arg, s.Rcpt)
+		if code := c.handlePassthru("RCPT", arg, s.Rcpt); code2xxSuccess(code) {
+			c.rcpts++
+		}
 	}
 }
 
@@ -302,11 +527,14 @@ func (c *Conn) handleReset() {
 	if s := c.Session(); s != nil {
 		c.handlePassthru("RSET", "", s.Reset)
 	}
+	c.setTransaction(false)
+	c.rcpts = 0
 }
 
 func (c *Conn) handleQuit() {
 	if s := c.Session(); s != nil {
 		c.handlePassthru("QUIT", "", s.Quit)
+		c.SetSession(nil)
 	}
 }
 
@@ -317,30 +545,33 @@ func (c *Conn) handleUnknown(cmd, arg string) {
 }
 
 // handlePassthru - pass the command and args through to the specified backend session function, handling responses transparently until success or permanent failure.
-func (c *Conn) handlePassthru(cmd, arg string, fn SessionFunc) {
+// Returns the final response code.
+func (c *Conn) handlePassthru(cmd, arg string, fn SessionFunc) int {
 	code, msg, err := fn(0, cmd, arg)
 	c.WriteResponse(code, NoEnhancedCode, msg)
 	if err != nil {
-		return
+		return code
 	}
 	// If we have an intermediate response, need to keep going
 	if code3xxIntermediate(code) {
 		for {
 			encoded, err := c.ReadLine()
 			if err != nil {
-				return
+				return 0
 			}
-			code, msg, err := fn(0, encoded, "")
+			code, msg, err = fn(0, encoded, "")
 			c.WriteResponse(code, NoEnhancedCode, msg)
-			if code2xxSuccess(code) || code5xxPermFail(code) || code == 0 {
-				return
+			if !code3xxIntermediate(code) {
+				return code
 			}
 		}
 	}
+	return code
 }
 
 // handleData
 func (c *Conn) handleData(arg string) {
+	defer c.setTransaction(false)
 	w, code, msg, err := c.Session().DataCommand()
 	// Enhanced code is at the beginning of msg, no need to add anything
 	c.WriteResponse(code, NoEnhancedCode, msg)
@@ -350,5 +581,130 @@ func (c *Conn) handleData(arg string) {
 	r := newDataReader(c)
 	code, msg, err = c.Session().Data(r, w)
 	io.Copy(ioutil.Discard, r) // Make sure all the incoming data has been consumed
-	c.WriteResponse(code, NoEnhancedCode, msg)
+	c.writeDataResponses(code, msg)
+}
+
+// writeDataResponses answers the end of the message data. LMTP needs a response for each accepted recipient.
+func (c *Conn) writeDataResponses(code int, msg string) {
+	if !c.server.LMTP {
+		c.WriteResponse(code, NoEnhancedCode, msg)
+		return
+	}
+	var resps []Response
+	if ls, ok := c.Session().(LMTPSession); ok {
+		resps = ls.LMTPResponses()
+	}
+	if len(resps) != c.rcpts {
+		// Session can't tell us about each recipient, so they all get the same outcome
+		resps = make([]Response, c.rcpts)
+		for i := range resps {
+			resps[i] = Response{Code: code, Msg: msg}
+		}
+	}
+	for _, r := range resps {
+		c.WriteResponse(r.Code, NoEnhancedCode, r.Msg)
+	}
+	c.rcpts = 0
+}
+
+// handleBdat passes a BDAT chunk upstream. Once the chunk size is known, the chunk is always read from the
+// client, even if the command is rejected, to keep the command stream in step.
+func (c *Conn) handleBdat(arg string) {
+	args := strings.Fields(arg)
+	if len(args) == 0 {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Syntax: BDAT chunk-size [LAST]")
+		return
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Invalid chunk size")
+		return
+	}
+	chunk := io.LimitReader(c.text.R, size)
+	last := len(args) == 2 && strings.EqualFold(args[1], "LAST")
+	s := c.Session()
+
+	var code int
+	var msg string
+	passed := false
+	switch {
+	case len(args) > 2 || (len(args) == 2 && !last):
+		code, msg = 501, "5.5.4 Syntax: BDAT chunk-size [LAST]"
+	case s == nil:
+		code, msg = 503, "5.5.1 Send EHLO first"
+	default:
+		code, msg, _ = s.Bdat(size, last, chunk)
+		passed = true
+	}
+	io.Copy(ioutil.Discard, chunk) // Make sure all the chunk has been consumed
+	if passed && last {
+		c.writeDataResponses(code, msg)
+	} else {
+		c.WriteResponse(code, NoEnhancedCode, msg)
+	}
+	if last {
+		c.setTransaction(false)
+	}
+}
+
+// isPipelinable reports whether a command may appear part-way through a pipelined group
+func isPipelinable(cmd string) bool {
+	return cmd == "MAIL" || cmd == "RCPT" || cmd == "RSET"
+}
+
+// handlePipeline gathers a group of commands the client has pipelined (RFC 2920), and passes them to the session together.
+// The group ends when no more input is waiting, or with a command that can't be pipelined, such as DATA, which is
+// then handled as usual.
+func (c *Conn) handlePipeline(ps PipelineSession, cmd, arg string) {
+	cmds := []Command{{Cmd: cmd, Arg: arg}}
+	var next *Command
+	var nextErr error
+	for c.text.R.Buffered() > 0 {
+		line, err := c.ReadLine()
+		if err != nil {
+			break
+		}
+		cmd, arg, err := ParseCmd(line)
+		if err != nil {
+			nextErr = err
+			break
+		}
+		cmd = strings.ToUpper(cmd)
+		if !isPipelinable(cmd) {
+			next = &Command{Cmd: cmd, Arg: arg}
+			break
+		}
+		cmds = append(cmds, Command{Cmd: cmd, Arg: arg})
+	}
+
+	inTxn := c.inTransaction()
+	for _, cmd := range cmds {
+		if cmd.Cmd == "MAIL" {
+			c.setTransaction(true) // busy while the group is upstream, as in handleMail
+		}
+	}
+	for i, resp := range ps.Pipeline(cmds) {
+		c.WriteResponse(resp.Code, NoEnhancedCode, resp.Msg)
+		switch cmds[i].Cmd {
+		case "MAIL":
+			c.rcpts = 0
+			inTxn = inTxn || code2xxSuccess(resp.Code)
+			c.setTransaction(inTxn)
+		case "RCPT":
+			if code2xxSuccess(resp.Code) {
+				c.rcpts++
+			}
+		case "RSET":
+			inTxn = false
+			c.setTransaction(false)
+			c.rcpts = 0
+		}
+	}
+
+	if nextErr != nil {
+		c.nbrErrors++
+		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Bad command")
+	} else if next != nil {
+		c.handle(next.Cmd, next.Arg)
+	}
 }
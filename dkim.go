@@ -0,0 +1,256 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains functions for DKIM signing messages (RFC 6376), with RSA-SHA256 or Ed25519-SHA256 (RFC 8463).
+
+// DefaultDKIMHeaders are the header fields signed, where present
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner is a MessageFilter that signs messages with the keys for the domain of their From address, using
+// relaxed header and simple body canonicalization. A domain with several keys, e.g. RSA and Ed25519, gets a
+// signature from each. Messages from domains without a key are passed on unsigned.
+type DKIMSigner struct {
+	Headers []string // header fields to sign, where present. Default DefaultDKIMHeaders
+	keys    map[string][]*dkimKey
+}
+
+type dkimKey struct {
+	selector string
+	algo     string // "rsa-sha256" or "ed25519-sha256"
+	signer   crypto.Signer
+}
+
+// NewDKIMSigner returns a signer with no keys
+func NewDKIMSigner() *DKIMSigner {
+	return &DKIMSigner{
+		Headers: DefaultDKIMHeaders,
+		keys:    make(map[string][]*dkimKey),
+	}
+}
+
+// AddKey adds the key to sign messages from domain with, published under selector. The key must be an
+// *rsa.PrivateKey or ed25519.PrivateKey.
+func (d *DKIMSigner) AddKey(domain, selector string, key crypto.Signer) error {
+	k := &dkimKey{selector: selector, signer: key}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		k.algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		k.algo = "ed25519-sha256"
+	default:
+		return fmt.Errorf("DKIM key %s for %s: unsupported key type %T", selector, domain, key)
+	}
+	domain = strings.ToLower(domain)
+	d.keys[domain] = append(d.keys[domain], k)
+	sort.Slice(d.keys[domain], func(i, j int) bool {
+		return d.keys[domain][i].selector < d.keys[domain][j].selector
+	})
+	return nil
+}
+
+// LoadDKIMKeys returns a signer with the keys in dir. Each key is a PEM file named for the DNS record its public
+// key is published in, i.e. selector._domainkey.domain.pem, holding an RSA key in PKCS #1 or PKCS #8 form, or an
+// Ed25519 key in PKCS #8 form. Other files are ignored.
+func LoadDKIMKeys(dir string) (*DKIMSigner, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*._domainkey.*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	d := NewDKIMSigner()
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), ".pem")
+		i := strings.Index(base, "._domainkey.")
+		selector, domain := base[:i], base[i+len("._domainkey."):]
+		key, err := loadDKIMKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.AddKey(domain, selector, key); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func loadDKIMKey(name string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", name)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", name, key)
+	}
+	return signer, nil
+}
+
+// Filter signs a message, if there is a key for the domain of its From address
+func (d *DKIMSigner) Filter(env *Envelope, h *Header, body io.Reader) (io.Reader, error) {
+	domain := fromDomain(h)
+	keys := d.keys[domain]
+	if len(keys) == 0 {
+		return body, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	bh := sha256.Sum256(canonicalBodySimple(b))
+	fields := d.signedFields(h)
+	now := time.Now().Unix()
+	for _, k := range keys {
+		sig, err := k.sign(domain, fields, bh[:], now, h.EOL())
+		if err != nil {
+			return nil, err
+		}
+		h.Prepend("DKIM-Signature", sig)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// fromDomain returns the lowercased domain of the message's From address, or "" if there isn't one
+func fromDomain(h *Header) string {
+	addrs, err := mail.ParseAddressList(h.Get("From"))
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	i := strings.LastIndexByte(addrs[0].Address, '@')
+	return strings.ToLower(addrs[0].Address[i+1:])
+}
+
+// signedFields returns the raw fields to sign, in the order they're hashed. Where a name appears more than
+// once, instances are taken from the bottom of the header up, as RFC 6376 section 5.4.2 requires.
+func (d *DKIMSigner) signedFields(h *Header) []string {
+	all := h.Fields()
+	var fields []string
+	for _, name := range d.Headers {
+		for i := len(all) - 1; i >= 0; i-- {
+			if strings.EqualFold(fieldName(all[i]), name) {
+				fields = append(fields, all[i])
+			}
+		}
+	}
+	return fields
+}
+
+// sign returns the value of a DKIM-Signature field, folded with eol
+func (k *dkimKey) sign(domain string, fields []string, bh []byte, now int64, eol string) (string, error) {
+	var names []string
+	hash := sha256.New()
+	for _, f := range fields {
+		names = append(names, strings.ToLower(fieldName(f)))
+		io.WriteString(hash, canonicalHeaderRelaxed(f)+"\r\n")
+	}
+	fold := ";" + eol + "\t"
+	value := "v=1; a=" + k.algo + "; c=relaxed/simple" + fold + "d=" + domain + "; s=" + k.selector + "; t=" +
+		strconv.FormatInt(now, 10) + fold + "h=" + foldList(names, ":", 72, eol+"\t") + fold +
+		"bh=" + base64.StdEncoding.EncodeToString(bh) + fold + "b="
+	// The signature covers its own field, with b= empty and no line ending
+	io.WriteString(hash, canonicalHeaderRelaxed("DKIM-Signature: "+value))
+	digest := hash.Sum(nil)
+
+	var sig []byte
+	var err error
+	if k.algo == "ed25519-sha256" {
+		sig, err = k.signer.Sign(rand.Reader, digest, crypto.Hash(0)) // Ed25519 signs the hash itself, per RFC 8463
+	} else {
+		sig, err = k.signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 72 {
+		value += b[:72] + eol + "\t"
+		b = b[72:]
+	}
+	return value + b, nil
+}
+
+// foldList joins items with sep, starting a new line, with eol, before any item that would take the line past n
+func foldList(items []string, sep string, n int, eol string) string {
+	var b strings.Builder
+	lineLen := 0
+	for i, item := range items {
+		if i > 0 {
+			b.WriteString(sep)
+			lineLen += len(sep)
+			if lineLen+len(item) > n {
+				b.WriteString(eol)
+				lineLen = 0
+			}
+		}
+		b.WriteString(item)
+		lineLen += len(item)
+	}
+	return b.String()
+}
+
+// wspRe matches runs of whitespace, which relaxed canonicalization reduces to a single space
+var wspRe = regexp.MustCompile(`[ \t]+`)
+
+// canonicalHeaderRelaxed returns a raw field in relaxed canonical form (RFC 6376 section 3.4.2), without a
+// line ending
+func canonicalHeaderRelaxed(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.NewReplacer("\r", "", "\n", "").Replace(field[i+1:])
+	value = wspRe.ReplaceAllString(value, " ")
+	return name + ":" + strings.Trim(value, " ")
+}
+
+// canonicalBodySimple returns a body in simple canonical form (RFC 6376 section 3.4.3), with CRLF line endings,
+// as it will be sent, and without trailing empty lines
+func canonicalBodySimple(b []byte) []byte {
+	var out bytes.Buffer
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+	c := out.Bytes()
+	for bytes.HasSuffix(c, []byte("\r\n")) {
+		c = c[:len(c)-2]
+	}
+	return append(c, '\r', '\n')
+}
@@ -0,0 +1,192 @@
+package smtpproxy_test
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+// testDKIMKeys writes an RSA and an Ed25519 key for example.com to dir, returning their public keys by selector
+func testDKIMKeys(t *testing.T, dir string) map[string]crypto.PublicKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"rsa._domainkey.example.com.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"ed._domainkey.example.com.pem":  {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ed": edPub}
+}
+
+var (
+	dkimTagRe = regexp.MustCompile(`\s+`)
+	dkimWSPRe = regexp.MustCompile(`[ \t]+`)
+	dkimBRe   = regexp.MustCompile(`b=[^;]*$`)
+)
+
+// verifyDKIM checks each DKIM-Signature on a message, returning the selectors that signed it
+func verifyDKIM(msg string, keys map[string]crypto.PublicKey) ([]string, error) {
+	msg = strings.Replace(strings.Replace(msg, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	i := strings.Index(msg, "\r\n\r\n")
+	if i < 0 {
+		return nil, errors.New("no header")
+	}
+	var fields []string
+	for _, line := range strings.SplitAfter(msg[:i+2], "\r\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			fields[len(fields)-1] += line
+		} else if line != "" {
+			fields = append(fields, line)
+		}
+	}
+	body := strings.TrimRight(msg[i+4:], "\r\n") + "\r\n"
+
+	relaxed := func(f string) string {
+		c := strings.IndexByte(f, ':')
+		value := strings.Replace(f[c+1:], "\r\n", "", -1)
+		value = strings.TrimSpace(dkimWSPRe.ReplaceAllString(value, " "))
+		return strings.ToLower(strings.TrimSpace(f[:c])) + ":" + value
+	}
+	var selectors []string
+	for _, f := range fields {
+		if !strings.HasPrefix(strings.ToLower(f), "dkim-signature:") {
+			continue
+		}
+		tags := make(map[string]string)
+		for _, tag := range strings.Split(dkimTagRe.ReplaceAllString(f[len("DKIM-Signature:"):], ""), ";") {
+			if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+				tags[kv[0]] = kv[1]
+			}
+		}
+		if tags["c"] != "relaxed/simple" || tags["d"] != "example.com" {
+			return nil, errors.New("unexpected tags " + f)
+		}
+		bh := sha256.Sum256([]byte(body))
+		if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+			return nil, errors.New("body hash mismatch")
+		}
+		h := sha256.New()
+		used := make(map[int]bool)
+		for _, name := range strings.Split(tags["h"], ":") {
+			for j := len(fields) - 1; j >= 0; j-- {
+				if !used[j] && strings.EqualFold(strings.TrimSpace(fields[j][:strings.IndexByte(fields[j], ':')]), name) {
+					used[j] = true
+					h.Write([]byte(relaxed(fields[j]) + "\r\n"))
+					break
+				}
+			}
+		}
+		h.Write([]byte(dkimBRe.ReplaceAllString(relaxed(f), "b=")))
+		sig, err := base64.StdEncoding.DecodeString(tags["b"])
+		if err != nil {
+			return nil, err
+		}
+		switch pub := keys[tags["s"]].(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), sig)
+		case ed25519.PublicKey:
+			if !ed25519.Verify(pub, h.Sum(nil), sig) {
+				err = errors.New("ed25519 signature mismatch")
+			}
+		default:
+			err = errors.New("unknown selector " + tags["s"])
+		}
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, tags["s"])
+	}
+	return selectors, nil
+}
+
+func TestDKIMSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := testDKIMKeys(t, dir)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600)
+	signer, err := smtpproxy.LoadDKIMKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages from the DATA path have LF line endings, which are CRLF once sent
+	const msg = "From: Sender <sender@Example.COM>\n" +
+		"To: rcpt@example.org\n" +
+		"Cc: copy@example.org\n" +
+		"Reply-To: reply@example.org\n" +
+		"Message-ID: <1@example.com>\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Transfer-Encoding: 7bit\n" +
+		"Subject:  A folded \t subject\n  with   spaces \n" +
+		"\n" +
+		"Body  text\n\n\n"
+	out, err := smtpproxy.FilterMessage(&smtpproxy.Envelope{}, strings.NewReader(msg), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := out.String()
+	selectors, err := verifyDKIM(signed, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(selectors, ",") != "rsa,ed" {
+		t.Errorf("Got signatures from %v, expected an Ed25519 and an RSA", selectors)
+	}
+	for _, line := range strings.Split(signed, "\n") {
+		if len(line) > 78 {
+			t.Errorf("Line longer than 78 characters: %q", line)
+		}
+	}
+
+	// Changes to the body or signed header fields are detected, but not to trailing blank lines
+	for _, c := range []struct {
+		old, new string
+		ok       bool
+	}{
+		{"Body  text", "Body text", false},
+		{"A folded", "A changed", false},
+		{"Subject:  A folded \t subject\n  with", "subject: A folded subject with", true},
+		{"Body  text\n\n\n", "Body  text\n", true},
+	} {
+		if _, err := verifyDKIM(strings.Replace(signed, c.old, c.new, 1), keys); (err == nil) != c.ok {
+			t.Errorf("%q to %q: got %v", c.old, c.new, err)
+		}
+	}
+
+	// Other domains are left unsigned
+	other := strings.Replace(msg, "Example.COM", "example.net", 1)
+	if out, err := smtpproxy.FilterMessage(&smtpproxy.Envelope{}, strings.NewReader(other), signer); err != nil || out.String() != other {
+		t.Errorf("Got %q, %v", out.String(), err)
+	}
+}
@@ -0,0 +1,60 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// This file contains functions for the proxy to change or reject messages on their way upstream.
+
+// MessageFilter can change a message on its way upstream, or reject it. It's given the envelope, the message
+// header, which it may change in place, and a reader of the message body. It returns a reader of the body to
+// send on: either body itself, or a rewritten version read from it. Changes to the header must be made before
+// Filter returns. The envelope's upstream response is not yet known.
+//
+// Returning an error, or an error from reading the returned body, rejects the message. An *SMTPError is sent
+// to the client as-is, others as a 451.
+type MessageFilter interface {
+	Filter(env *Envelope, h *Header, body io.Reader) (io.Reader, error)
+}
+
+// MessageFilterFunc allows an ordinary function to be used as a MessageFilter
+type MessageFilterFunc func(env *Envelope, h *Header, body io.Reader) (io.Reader, error)
+
+// Filter calls f(env, h, body)
+func (f MessageFilterFunc) Filter(env *Envelope, h *Header, body io.Reader) (io.Reader, error) {
+	return f(env, h, body)
+}
+
+// ErrMessageRejected may be returned by a MessageFilter to refuse a message
+var ErrMessageRejected = &SMTPError{
+	Code:         550,
+	EnhancedCode: EnhancedCode{5, 7, 1},
+	Message:      "Message rejected",
+}
+
+// FilterMessage passes a message through each of filters in turn, returning the result in full. The whole
+// message is read before anything is returned, so that a rejection can't come part way through sending it on.
+func FilterMessage(env *Envelope, msg io.Reader, filters ...MessageFilter) (*bytes.Buffer, error) {
+	br := bufio.NewReader(msg)
+	h, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = br
+	for _, f := range filters {
+		if body, err = f.Filter(env, h, body); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	if _, err = h.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(&out, body); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
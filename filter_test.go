@@ -0,0 +1,136 @@
+package smtpproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+func TestHeader(t *testing.T) {
+	const msg = "Received: from a\r\n\tby b\r\n" +
+		"Subject: Hello\r\n" +
+		"X-Spam: yes\r\n" +
+		"x-spam: really\r\n" +
+		"\r\n" +
+		"Body: not a header\r\n"
+	br := bufio.NewReader(strings.NewReader(msg))
+	h, err := smtpproxy.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("received"); got != "from a\tby b" {
+		t.Errorf("Got unfolded value %q", got)
+	}
+	if got := h.Values("X-SPAM"); len(got) != 2 || got[1] != "really" {
+		t.Errorf("Got values %q", got)
+	}
+	if h.EOL() != "\r\n" {
+		t.Errorf("Got line ending %q", h.EOL())
+	}
+
+	// Unchanged, the message is the same byte for byte
+	var b bytes.Buffer
+	if _, err := h.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(&b, br); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != msg {
+		t.Errorf("Got %q, expected %q", b.String(), msg)
+	}
+
+	h.Del("x-spam")
+	h.Set("Subject", "Changed")
+	h.Add("X-Added", "1")
+	h.Prepend("X-First", "0")
+	b.Reset()
+	h.WriteTo(&b)
+	expected := "X-First: 0\r\nReceived: from a\r\n\tby b\r\nSubject: Changed\r\nX-Added: 1\r\n\r\n"
+	if b.String() != expected {
+		t.Errorf("Got %q, expected %q", b.String(), expected)
+	}
+}
+
+func TestHeaderEdgeCases(t *testing.T) {
+	for _, c := range []struct {
+		in, eol, header, body string
+	}{
+		{in: "Subject: LF\n\nbody\n", eol: "\n", header: "Subject: LF\n\n", body: "body\n"},
+		{in: "no header here\r\n", eol: "\r\n", header: "", body: "no header here\r\n"},
+		{in: "Subject: no body", eol: "\r\n", header: "Subject: no body\r\n", body: ""},
+		{in: "Subject: x\r\nnot a field\r\n", eol: "\r\n", header: "Subject: x\r\n", body: "not a field\r\n"},
+		{in: "", eol: "\r\n", header: "", body: ""},
+	} {
+		br := bufio.NewReader(strings.NewReader(c.in))
+		h, err := smtpproxy.ReadHeader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		h.WriteTo(&b)
+		body, _ := ioutil.ReadAll(br)
+		if h.EOL() != c.eol || b.String() != c.header || string(body) != c.body {
+			t.Errorf("%q: got eol %q, header %q, body %q", c.in, h.EOL(), b.String(), body)
+		}
+	}
+
+	// A header added to a message without one is separated from the body
+	br := bufio.NewReader(strings.NewReader("just a body\r\n"))
+	h, _ := smtpproxy.ReadHeader(br)
+	h.Add("Subject", "added")
+	var b bytes.Buffer
+	h.WriteTo(&b)
+	io.Copy(&b, br)
+	if b.String() != "Subject: added\r\n\r\njust a body\r\n" {
+		t.Errorf("Got %q", b.String())
+	}
+}
+
+func TestFilterMessage(t *testing.T) {
+	env := &smtpproxy.Envelope{MailFrom: "sender@example.com", RcptTo: []string{"rcpt@example.com"}}
+	tag := smtpproxy.MessageFilterFunc(func(env *smtpproxy.Envelope, h *smtpproxy.Header, body io.Reader) (io.Reader, error) {
+		h.Add("X-Sender", env.MailFrom)
+		return body, nil
+	})
+	upper := smtpproxy.MessageFilterFunc(func(env *smtpproxy.Envelope, h *smtpproxy.Header, body io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(body)
+		return strings.NewReader(strings.ToUpper(string(b))), err
+	})
+	out, err := smtpproxy.FilterMessage(env, strings.NewReader("Subject: hi\r\n\r\nhello\r\n"), tag, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Subject: hi\r\nX-Sender: sender@example.com\r\n\r\nHELLO\r\n"; out.String() != expected {
+		t.Errorf("Got %q, expected %q", out.String(), expected)
+	}
+
+	// Errors, including those from reading the filtered body, reject the message
+	reject := smtpproxy.MessageFilterFunc(func(env *smtpproxy.Envelope, h *smtpproxy.Header, body io.Reader) (io.Reader, error) {
+		return nil, smtpproxy.ErrMessageRejected
+	})
+	if _, err := smtpproxy.FilterMessage(env, strings.NewReader("Subject: hi\r\n\r\nhello\r\n"), reject, tag); err != smtpproxy.ErrMessageRejected {
+		t.Errorf("Expected %v, got %v", smtpproxy.ErrMessageRejected, err)
+	}
+	readErr := errors.New("body read error")
+	broken := smtpproxy.MessageFilterFunc(func(env *smtpproxy.Envelope, h *smtpproxy.Header, body io.Reader) (io.Reader, error) {
+		return io.MultiReader(body, &errorReader{readErr}), nil
+	})
+	if _, err := smtpproxy.FilterMessage(env, strings.NewReader("Subject: hi\r\n\r\nhello\r\n"), broken); err != readErr {
+		t.Errorf("Expected %v, got %v", readErr, err)
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
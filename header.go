@@ -0,0 +1,199 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// This file contains functions for reading and changing message header fields.
+
+// Header is the header of a message. Fields are kept in order, exactly as received, so that a header sent on
+// unchanged is byte for byte the same. Field names are matched case insensitively.
+type Header struct {
+	fields []string // each field including any folded lines, and the line ending
+	sep    string   // the blank line ending the header, as received. Empty if there was none
+	eol    string   // line ending used by the message, for new fields
+	none   bool     // the message had no header, so one added needs a blank line after it
+}
+
+// ReadHeader reads a message header, up to and including the blank line that ends it. The body can then be
+// read from r. A line that is neither a field nor a continuation also ends the header, and is left in r.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	h := &Header{eol: "\r\n"}
+	eolKnown := false
+	for {
+		peek, err := r.Peek(1)
+		if err == io.EOF {
+			h.none = len(h.fields) == 0
+			return h, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if peek[0] == ' ' || peek[0] == '\t' {
+			if len(h.fields) == 0 {
+				h.none = true // a continuation with nothing to continue, so not a header
+				return h, nil
+			}
+		} else if !isFieldStart(r) {
+			h.none = len(h.fields) == 0
+			return h, nil
+		}
+		line, err := r.ReadString('\n')
+		if !eolKnown && strings.HasSuffix(line, "\n") {
+			if !strings.HasSuffix(line, "\r\n") {
+				h.eol = "\n"
+			}
+			eolKnown = true
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			h.sep = line
+			return h, nil
+		}
+		if peek[0] == ' ' || peek[0] == '\t' {
+			h.fields[len(h.fields)-1] += line
+		} else {
+			h.fields = append(h.fields, line)
+		}
+		if err == io.EOF {
+			h.fields[len(h.fields)-1] += h.eol // the message ends part way through a line
+			return h, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isFieldStart reports whether r is at the start of a header field, or the blank line ending the header
+func isFieldStart(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, _ := r.Peek(n)
+		if len(b) < n {
+			return false
+		}
+		c := b[n-1]
+		switch {
+		case c == ':':
+			return n > 1
+		case c == '\n' || c == '\r':
+			return n == 1 // a blank line
+		case c <= ' ' || c > '~':
+			return false
+		}
+	}
+}
+
+// fieldName returns the name of a raw field
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return field[:i]
+	}
+	return ""
+}
+
+// fieldValue returns the value of a raw field, unfolded and trimmed
+func fieldValue(field string) string {
+	v := field[strings.IndexByte(field, ':')+1:]
+	v = strings.NewReplacer("\r\n", "", "\n", "").Replace(v)
+	return strings.TrimSpace(v)
+}
+
+// Get returns the value of the first field with the given name, unfolded, or "" if there is none
+func (h *Header) Get(name string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(fieldName(f), name) {
+			return fieldValue(f)
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields with the given name, unfolded, in order
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(fieldName(f), name) {
+			values = append(values, fieldValue(f))
+		}
+	}
+	return values
+}
+
+// Fields returns the raw fields, in order, each including any folded lines and the line ending
+func (h *Header) Fields() []string {
+	fields := make([]string, len(h.fields))
+	copy(fields, h.fields)
+	return fields
+}
+
+// format makes a raw field. The value should already be folded if necessary, with the message's line ending.
+func (h *Header) format(name, value string) string {
+	return name + ": " + value + h.eol
+}
+
+// Add appends a field at the end of the header
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, h.format(name, value))
+}
+
+// Prepend inserts a field at the top of the header, as trace fields such as Received are
+func (h *Header) Prepend(name, value string) {
+	h.fields = append([]string{h.format(name, value)}, h.fields...)
+}
+
+// Set replaces the first field with the given name, removing any others, or adds the field if there is none
+func (h *Header) Set(name, value string) {
+	found := false
+	kept := h.fields[:0]
+	for _, f := range h.fields {
+		if strings.EqualFold(fieldName(f), name) {
+			if found {
+				continue
+			}
+			f = h.format(name, value)
+			found = true
+		}
+		kept = append(kept, f)
+	}
+	h.fields = kept
+	if !found {
+		h.Add(name, value)
+	}
+}
+
+// Del removes all fields with the given name
+func (h *Header) Del(name string) {
+	kept := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(fieldName(f), name) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
+}
+
+// EOL returns the line ending used by the message, "\r\n" or "\n"
+func (h *Header) EOL() string {
+	return h.eol
+}
+
+// WriteTo writes the header, including the blank line that ends it
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, f := range h.fields {
+		m, err := io.WriteString(w, f)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	sep := h.sep
+	if h.none && len(h.fields) > 0 {
+		sep = h.eol
+	}
+	m, err := io.WriteString(w, sep)
+	return n + int64(m), err
+}
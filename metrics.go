@@ -0,0 +1,308 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains metrics of the proxy's activity, exposed in the Prometheus text format.
+
+// Metrics counts what the proxy is doing. Give the same Metrics to the Server, for the downstream side, and to
+// ProxyBackend.SetMetrics, for the upstream side, then serve it over HTTP for Prometheus to scrape. All methods
+// are safe for concurrent use, and do nothing on a nil *Metrics.
+type Metrics struct {
+	downstreamConns      *gaugeMetric
+	downstreamConnsTotal *counterVec
+	upstreamDialSeconds  *histogramVec
+	upstreamDialFailures *counterVec
+	upstreamResponses    *counterVec
+	messageBytes         *histogramVec
+	messageSeconds       *histogramVec
+	startTLS             *counterVec
+	all                  []metric
+}
+
+// NewMetrics returns a set of metrics, all zero
+func NewMetrics() *Metrics {
+	secs := []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	m := &Metrics{
+		downstreamConns: &gaugeMetric{name: "smtpproxy_downstream_connections",
+			help: "Client connections currently open"},
+		downstreamConnsTotal: newCounterVec("smtpproxy_downstream_connections_total",
+			"Client connections accepted"),
+		upstreamDialSeconds: newHistogramVec("smtpproxy_upstream_dial_seconds",
+			"Time taken to connect to an upstream server and read its greeting", secs),
+		upstreamDialFailures: newCounterVec("smtpproxy_upstream_dial_failures_total",
+			"Upstream connections that failed, or were refused at the greeting or EHLO"),
+		upstreamResponses: newCounterVec("smtpproxy_upstream_responses_total",
+			"Upstream responses to commands passed through, by command and response code", "command", "code"),
+		messageBytes: newHistogramVec("smtpproxy_message_bytes",
+			"Size of messages sent upstream", []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8}, "command"),
+		messageSeconds: newHistogramVec("smtpproxy_message_seconds",
+			"Time taken to send messages upstream, until the upstream responds", secs, "command"),
+		startTLS: newCounterVec("smtpproxy_starttls_total",
+			"STARTTLS attempts, by side (downstream or upstream) and result (success or failure)", "side", "result"),
+	}
+	m.all = []metric{m.downstreamConns, m.downstreamConnsTotal, m.upstreamDialSeconds, m.upstreamDialFailures,
+		m.upstreamResponses, m.messageBytes, m.messageSeconds, m.startTLS}
+	return m
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	for _, mt := range m.all {
+		if err := mt.write(cw); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ServeHTTP serves the metrics, for Prometheus to scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// connOpened and connClosed record the number of client connections open
+func (m *Metrics) connOpened(open int) {
+	if m != nil {
+		m.downstreamConns.set(float64(open))
+		m.downstreamConnsTotal.add(1)
+	}
+}
+
+func (m *Metrics) connClosed(open int) {
+	if m != nil {
+		m.downstreamConns.set(float64(open))
+	}
+}
+
+// dialed records the outcome of connecting to an upstream server, started at start
+func (m *Metrics) dialed(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.upstreamDialFailures.add(1)
+		return
+	}
+	m.upstreamDialSeconds.observe(time.Since(start).Seconds())
+}
+
+// metricsCommands are the commands counted individually. Others, which clients could choose freely, are
+// counted together.
+var metricsCommands = map[string]bool{
+	"MAIL": true, "RCPT": true, "RSET": true, "QUIT": true, "NOOP": true, "VRFY": true, "EXPN": true,
+	"HELP": true, "AUTH": true, "DATA": true, "BDAT": true, "STARTTLS": true,
+}
+
+// response records an upstream response to cmd
+func (m *Metrics) response(cmd string, code int) {
+	if m == nil {
+		return
+	}
+	cmd = strings.ToUpper(cmd)
+	if !metricsCommands[cmd] {
+		cmd = "OTHER"
+	}
+	m.upstreamResponses.add(1, cmd, strconv.Itoa(code))
+}
+
+// message records a message sent upstream with cmd, DATA or BDAT, started at start
+func (m *Metrics) message(cmd string, bytes int64, start time.Time, code int) {
+	if m == nil {
+		return
+	}
+	m.messageBytes.observe(float64(bytes), cmd)
+	m.messageSeconds.observe(time.Since(start).Seconds(), cmd)
+	m.response(cmd, code)
+}
+
+// tls records the result of STARTTLS on side, "downstream" or "upstream"
+func (m *Metrics) tls(side string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.startTLS.add(1, side, result)
+}
+
+//-----------------------------------------------------------------------------
+// Metric types
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// labelsKey joins label values into a map key
+func labelsKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// labelsString formats label names and values, with extra appended, as Prometheus expects
+func labelsString(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type gaugeMetric struct {
+	name, help string
+	locker     sync.Mutex
+	value      float64
+}
+
+func (g *gaugeMetric) set(v float64) {
+	g.locker.Lock()
+	g.value = v
+	g.locker.Unlock()
+}
+
+func (g *gaugeMetric) write(w io.Writer) error {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value))
+	return err
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	locker     sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.locker.Lock()
+	c.values[labelsKey(labelValues)] += v
+	c.locker.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+		return err
+	}
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		c.values[""] = 0 // an unlabelled counter is always shown
+	}
+	for _, key := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, labelsString(c.labels, key), formatFloat(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending
+	locker     sync.Mutex
+	series     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	key := labelsKey(labelValues)
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	if len(h.labels) == 0 && len(h.series) == 0 {
+		h.series[""] = &histogram{counts: make([]uint64, len(h.buckets))}
+	}
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range append(h.buckets[:len(h.buckets):len(h.buckets)], math.Inf(1)) {
+			if i < len(s.counts) {
+				cumulative += s.counts[i]
+			} else {
+				cumulative = s.count
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelsString(h.labels, key, "le", formatFloat(le)), cumulative); err != nil {
+				return err
+			}
+		}
+		labels := labelsString(h.labels, key)
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, labels, formatFloat(s.sum), h.name, labels, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
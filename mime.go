@@ -0,0 +1,247 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// This file contains functions for rewriting the text content of MIME messages as they stream through.
+
+// MIMERewriter rewrites the content of a text part of a message. mediaType is "text/plain" or "text/html", and
+// h is the part's header, e.g. to find the charset. The decoded content is read from r, and the replacement
+// written to w, which encodes it as the original was.
+type MIMERewriter func(mediaType string, h *Header, r io.Reader, w io.Writer) error
+
+// RewriteMIME copies a message body to w, walking its MIME structure, and passing the content of each
+// text/plain and text/html part, other than attachments, through rewrite. Base64 and quoted-printable content
+// is decoded for rewrite, then encoded again with lines of at most 76 characters, as RFC 2045 requires. Other
+// parts, headers, boundaries, preambles and epilogues are copied as they are. h is the message header, which is
+// not itself written.
+func RewriteMIME(h *Header, body io.Reader, w io.Writer, rewrite MIMERewriter) error {
+	m := &mimeWalker{br: bufio.NewReader(body), w: w, rewrite: rewrite, eol: h.EOL()}
+	_, err := m.entity(h, nil)
+	return err
+}
+
+// MIMEFilter returns a MessageFilter that rewrites the text parts of each message. See RewriteMIME
+func MIMEFilter(rewrite MIMERewriter) MessageFilter {
+	return MessageFilterFunc(func(env *Envelope, h *Header, body io.Reader) (io.Reader, error) {
+		var out bytes.Buffer
+		if err := RewriteMIME(h, body, &out, rewrite); err != nil {
+			return nil, err
+		}
+		return &out, nil
+	})
+}
+
+type mimeWalker struct {
+	br      *bufio.Reader
+	w       io.Writer
+	rewrite MIMERewriter
+	eol     string
+}
+
+// entity processes the body of an entity whose header has already been written, up to a delimiter line of
+// one of the enclosing boundaries. Returns that line, or "" at the end of the message.
+func (m *mimeWalker) entity(h *Header, boundaries []string) (string, error) {
+	mediaType, params := contentType(h)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		return m.multipart(params["boundary"], boundaries)
+	case (mediaType == "text/plain" || mediaType == "text/html") && !isAttachment(h):
+		return m.text(mediaType, h, boundaries)
+	}
+	return m.copyUntil(boundaries)
+}
+
+// contentType returns the media type of an entity, lowercased, and its parameters. The default is text/plain.
+// An invalid Content-Type is treated as application/octet-stream, so the content is left alone.
+func contentType(h *Header) (string, map[string]string) {
+	v := h.Get("Content-Type")
+	if v == "" {
+		return "text/plain", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+	return mediaType, params
+}
+
+func isAttachment(h *Header) bool {
+	disposition, _, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	return disposition == "attachment"
+}
+
+// multipart processes the preamble, parts and epilogue of a multipart entity
+func (m *mimeWalker) multipart(boundary string, outer []string) (string, error) {
+	inner := append(append([]string{}, outer...), boundary)
+	delim, err := m.copyUntil(inner) // preamble
+	for err == nil && isDelimiter(delim, []string{boundary}) {
+		if _, err = io.WriteString(m.w, delim); err != nil {
+			return "", err
+		}
+		if strings.TrimRight(delim, " \t\r\n") == "--"+boundary+"--" {
+			return m.copyUntil(outer) // epilogue
+		}
+		var h *Header
+		if h, err = ReadHeader(m.br); err != nil {
+			return "", err
+		}
+		if _, err = h.WriteTo(m.w); err != nil {
+			return "", err
+		}
+		delim, err = m.entity(h, inner)
+	}
+	return delim, err // an outer delimiter, or the end of a message missing its close delimiter
+}
+
+// text passes the content of a text part through the rewriter, decoding and encoding it
+func (m *mimeWalker) text(mediaType string, h *Header, boundaries []string) (string, error) {
+	br := &boundaryReader{m: m, boundaries: boundaries}
+	var r io.Reader = br
+	tw := &trackingWriter{w: m.w}
+	var w io.Writer = tw
+	var encoder io.Closer
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r) // ignores line breaks
+		enc := base64.NewEncoder(base64.StdEncoding, NewLineSplitterWriter(76, []byte(m.eol), tw))
+		w, encoder = enc, enc
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+		var qw io.Writer = tw
+		if m.eol == "\n" {
+			qw = &lfWriter{w: tw}
+		}
+		enc := quotedprintable.NewWriter(qw)
+		w, encoder = enc, enc
+	}
+	if err := m.rewrite(mediaType, h, r, w); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(ioutil.Discard, br); err != nil { // anything the rewriter didn't read
+		return "", err
+	}
+	if encoder != nil {
+		if err := encoder.Close(); err != nil {
+			return "", err
+		}
+	}
+	if tw.n > 0 && tw.last != '\n' {
+		// The delimiter must start on a line of its own
+		if _, err := io.WriteString(m.w, m.eol); err != nil {
+			return "", err
+		}
+	}
+	return br.delim, nil
+}
+
+// copyUntil copies lines up to a delimiter line of one of boundaries, returning that line, or "" at the end
+// of the message
+func (m *mimeWalker) copyUntil(boundaries []string) (string, error) {
+	for {
+		line, err := m.br.ReadString('\n')
+		if isDelimiter(line, boundaries) {
+			return line, nil
+		}
+		if _, werr := io.WriteString(m.w, line); werr != nil {
+			return "", werr
+		}
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// isDelimiter reports whether line is a delimiter, or close delimiter, for one of boundaries
+func isDelimiter(line string, boundaries []string) bool {
+	if !strings.HasPrefix(line, "--") {
+		return false
+	}
+	line = strings.TrimRight(line, " \t\r\n") // transport padding is allowed after the boundary
+	for _, b := range boundaries {
+		if line == "--"+b || line == "--"+b+"--" {
+			return true
+		}
+	}
+	return false
+}
+
+// boundaryReader reads the content of a part, up to the next delimiter line
+type boundaryReader struct {
+	m          *mimeWalker
+	boundaries []string
+	line       string // the rest of the current line
+	delim      string // the delimiter that ended the part, once reached
+	done       bool
+}
+
+func (b *boundaryReader) Read(p []byte) (int, error) {
+	for b.line == "" {
+		if b.done {
+			return 0, io.EOF
+		}
+		line, err := b.m.br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if isDelimiter(line, b.boundaries) {
+			b.delim, b.done = line, true
+			return 0, io.EOF
+		}
+		b.line, b.done = line, err == io.EOF
+	}
+	n := copy(p, b.line)
+	b.line = b.line[n:]
+	return n, nil
+}
+
+// trackingWriter remembers how much has been written, and the last byte
+type trackingWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		t.n += int64(n)
+		t.last = p[n-1]
+	}
+	return n, err
+}
+
+// lfWriter converts CRLF line endings to LF, for messages that use them
+type lfWriter struct {
+	w  io.Writer
+	cr bool // the last byte written was CR, held back in case LF follows
+}
+
+func (l *lfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if l.cr && c != '\n' {
+			out = append(out, '\r')
+		}
+		l.cr = c == '\r'
+		if !l.cr {
+			out = append(out, c)
+		}
+	}
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,199 @@
+package smtpproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+// string params: outer boundary, inner boundary, plain text (QP), html (base64), attachment (base64)
+const nestedEmailTemplate = `From: sender@example.com
+Subject: nested
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="%[1]s"
+
+This is the preamble.
+--%[1]s
+Content-Type: multipart/alternative; boundary="%[2]s"
+
+--%[2]s
+Content-Type: text/plain; charset="UTF-8"
+Content-Transfer-Encoding: quoted-printable
+
+%[3]s
+--%[2]s
+Content-Type: text/html; charset="UTF-8"
+Content-Transfer-Encoding: base64
+
+%[4]s
+--%[2]s--
+
+--%[1]s
+Content-Type: text/plain; name="notes.txt"
+Content-Disposition: attachment; filename="notes.txt"
+Content-Transfer-Encoding: base64
+
+%[5]s
+--%[1]s--
+This is the epilogue.
+`
+
+func encodeQP(s string) string {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	io.WriteString(w, s)
+	w.Close()
+	return b.String()
+}
+
+func encodeBase64(s string) string {
+	var b bytes.Buffer
+	w := base64.NewEncoder(base64.StdEncoding, smtpproxy.NewLineSplitterWriter(76, []byte("\r\n"), &b))
+	io.WriteString(w, s)
+	w.Close()
+	return b.String()
+}
+
+// rewriteMessage passes a message through RewriteMIME, returning the result including the header
+func rewriteMessage(t *testing.T, msg string, rewrite smtpproxy.MIMERewriter) string {
+	br := bufio.NewReader(strings.NewReader(msg))
+	h, err := smtpproxy.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	h.WriteTo(&out)
+	if err := smtpproxy.RewriteMIME(h, br, &out, rewrite); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// partContents returns the decoded content of each leaf part of a message, depth first
+func partContents(t *testing.T, contentType string, r io.Reader) []string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{string(b)}
+	}
+	var contents []string
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart() // decodes quoted-printable, but not base64
+		if err == io.EOF {
+			return contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pr io.Reader = p
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			pr = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		contents = append(contents, partContents(t, p.Header.Get("Content-Type"), pr)...)
+	}
+}
+
+func TestRewriteMIME(t *testing.T) {
+	plain := "Plain text with a long line that quoted-printable must wrap, é, and more text to take it past 76 characters"
+	html := testHTML(testHTMLTemplate1, "https://example.com/first", "https://example.com/second")
+	attachment := "Click here to see this attachment, which must not change"
+	msg := fmt.Sprintf(strings.Replace(nestedEmailTemplate, "\n", "\r\n", -1),
+		"outer", "inner", encodeQP(plain), encodeBase64(html), encodeBase64(attachment))
+
+	var seen []string
+	out := rewriteMessage(t, msg, func(mediaType string, h *smtpproxy.Header, r io.Reader, w io.Writer) error {
+		seen = append(seen, mediaType)
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		content := string(b)
+		if mediaType == "text/plain" {
+			content += "Footer added\r\n"
+		} else {
+			content = strings.Replace(content, "Click", "Tap", -1)
+		}
+		_, err = io.WriteString(w, content)
+		return err
+	})
+	if strings.Join(seen, ",") != "text/plain,text/html" {
+		t.Errorf("Rewriter saw %v, expected the two text parts but not the attachment", seen)
+	}
+	for _, s := range []string{"This is the preamble.\r\n--outer\r\n", "\r\n--outer--\r\nThis is the epilogue.\r\n", encodeBase64(attachment)} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q unchanged in %q", s, out)
+		}
+	}
+	for _, line := range strings.Split(out, "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("Line longer than 76 characters: %q", line)
+		}
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := partContents(t, m.Header.Get("Content-Type"), m.Body)
+	// The line break before a delimiter belongs to the delimiter, so multipart.Reader drops it
+	expected := []string{plain + "\r\nFooter added", strings.Replace(html, "Click", "Tap", -1), attachment}
+	if len(contents) != len(expected) {
+		t.Fatalf("Got %d parts, expected %d", len(contents), len(expected))
+	}
+	for i := range expected {
+		if contents[i] != expected[i] {
+			t.Errorf("Part %d: got %q, expected %q", i, contents[i], expected[i])
+		}
+	}
+
+	// Unchanged content comes out as it went in
+	copyContent := func(mediaType string, h *smtpproxy.Header, r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	if out := rewriteMessage(t, msg, copyContent); out != msg {
+		t.Errorf("Got %q, expected %q", out, msg)
+	}
+}
+
+func TestRewriteMIMESinglePart(t *testing.T) {
+	upper := func(mediaType string, h *smtpproxy.Header, r io.Reader, w io.Writer) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bytes.ToUpper(b))
+		return err
+	}
+	// A message without a Content-Type is plain text, and LF line endings are kept
+	if out := rewriteMessage(t, PlainEmail(), upper); !strings.HasSuffix(out, "\n\nSHORT PLAINTEXT\n") {
+		t.Errorf("Got %q", out)
+	}
+	msg := "Content-Type: text/html\nContent-Transfer-Encoding: quoted-printable\n\n<p>caf=C3=A9</p>\n"
+	if out := rewriteMessage(t, msg, upper); !strings.HasSuffix(out, "\n\n<P>CAF=C3=89</P>\n") {
+		t.Errorf("Got %q", out)
+	}
+	// Other types are left alone
+	msg = "Content-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw0KGgo=\r\n"
+	if out := rewriteMessage(t, msg, upper); out != msg {
+		t.Errorf("Got %q, expected %q", out, msg)
+	}
+}
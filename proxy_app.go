@@ -2,11 +2,17 @@
 package smtpproxy
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -36,11 +42,42 @@ func CreateProxy(inHostPort, outHostPort string, verboseOpt bool, cert, privkey
 //-----------------------------------------------------------------------------
 // Backend handlers
 
+// UpstreamTLS selects how the proxy secures its connection to the upstream server
+type UpstreamTLS int
+
+const (
+	// UpstreamMirrorTLS issues STARTTLS upstream when, and only when, the downstream client does
+	UpstreamMirrorTLS UpstreamTLS = iota
+	// UpstreamPlain never secures the upstream connection. Downstream STARTTLS is handled by the proxy alone
+	UpstreamPlain
+	// UpstreamStartTLS always issues STARTTLS upstream after the first EHLO, failing if the upstream can't
+	UpstreamStartTLS
+	// UpstreamImplicitTLS connects to the upstream with TLS from the outset (SMTPS, usually port 465)
+	UpstreamImplicitTLS
+)
+
 // The ProxyBackend implements SMTP server methods.
 type ProxyBackend struct {
 	outHostPort        string
 	verbose            bool
 	insecureSkipVerify bool
+	upstreamTLS        UpstreamTLS
+	upstreamLMTP       bool
+	authenticator      Authenticator     // if set, the proxy authenticates clients itself
+	credentials        CredentialsFunc   // upstream credentials for locally authenticated clients
+	router             UpstreamRouter    // if set, chooses the upstream per client instead of outHostPort
+	pool               *UpstreamPool     // if set, upstreams to fail over between instead of outHostPort
+	rcptRouter         RecipientRouter   // if set, the upstream is chosen per transaction, once recipients are known
+	clientPool         *ClientPool       // if set, upstream connections are reused across sessions
+	queue              *Queue            // if set, messages are stored and forwarded later
+	archiver           MessageArchiver   // if set, receives a copy of each message relayed
+	filters            []MessageFilter   // applied to each message in turn, before it's relayed or queued
+	signer             *DKIMSigner       // if set, signs each message after the filters
+	metrics            *Metrics          // if set, counts upstream activity
+	txnLogger          TransactionLogger // if set, receives a record of each transaction
+	trace              *TraceHeaders     // if set, headers added to each message received
+	hello              string            // if set, the name given in EHLO upstream
+	insecureAuth       bool              // credentials may be sent upstream without TLS
 }
 
 // NewBackend creates a proxy backend with specified params
@@ -58,6 +95,123 @@ func (bkd *ProxyBackend) SetVerbose(v bool) {
 	bkd.verbose = v
 }
 
+// SetUpstreamTLS chooses how the upstream connection is secured. The default is UpstreamMirrorTLS
+func (bkd *ProxyBackend) SetUpstreamTLS(mode UpstreamTLS) {
+	bkd.upstreamTLS = mode
+}
+
+// SetLocalAuth makes the proxy authenticate downstream clients itself, with AUTH PLAIN or LOGIN, rather than
+// passing AUTH through. Once a client is authenticated, the credentials chosen for it by creds (which may be nil)
+// are presented upstream instead. Clients must authenticate before sending mail.
+func (bkd *ProxyBackend) SetLocalAuth(a Authenticator, creds CredentialsFunc) {
+	bkd.authenticator = a
+	bkd.credentials = creds
+}
+
+// SetUpstreamLMTP makes the proxy speak LMTP to the upstream server, e.g. a local delivery agent.
+// The upstream address may then be a Unix socket path.
+func (bkd *ProxyBackend) SetUpstreamLMTP(lmtp bool) {
+	bkd.upstreamLMTP = lmtp
+}
+
+// SetRouter chooses the upstream server for each client, e.g. by source subnet, in place of the
+// fixed upstream host:port. The router may also reject clients.
+func (bkd *ProxyBackend) SetRouter(r UpstreamRouter) {
+	bkd.router = r
+}
+
+// SetUpstreams makes the proxy choose from a pool of upstream servers for each session, in place of the fixed
+// upstream host:port, failing over to the next if the connection, the 220 greeting or EHLO fails. A router,
+// if set, takes precedence.
+func (bkd *ProxyBackend) SetUpstreams(pool *UpstreamPool) {
+	bkd.pool = pool
+}
+
+// SetRecipientRouter makes the proxy choose the upstream server for each mail transaction from its envelope,
+// e.g. by the recipient domain's MX records, in place of any fixed upstreams. The upstream connection is then
+// delayed until the first RCPT TO. Until then, the proxy answers the client itself, handling STARTTLS locally.
+// Upstream STARTTLS is used when offered, without checking the certificate, as is usual for MX delivery. With
+// UpstreamStartTLS it's always used, and checked, and with UpstreamPlain never. AUTH is only available with
+// SetLocalAuth. The proxy gives this host's name in EHLO, unless SetHelloName is used.
+func (bkd *ProxyBackend) SetRecipientRouter(r RecipientRouter) {
+	bkd.rcptRouter = r
+}
+
+// SetClientPool makes the proxy keep upstream connections when clients QUIT, for reuse by later sessions,
+// saving the time taken to connect, greet, secure and authenticate. A connection is not reused if the client
+// passed AUTH through to it, or in UpstreamMirrorTLS mode, if it's using TLS.
+func (bkd *ProxyBackend) SetClientPool(p *ClientPool) {
+	bkd.clientPool = p
+}
+
+// SetQueue makes the proxy store each message in q, replying to the client as soon as it's safely on disk,
+// rather than relaying it straight away. Run q with bkd.Deliver to send the messages on. Clients are answered
+// by the proxy itself, as with SetRecipientRouter, and AUTH is only available with SetLocalAuth. Messages go to
+// the upstreams chosen by the recipient router if set, otherwise by the upstream pool or fixed upstream; a
+// client router is not consulted.
+func (bkd *ProxyBackend) SetQueue(q *Queue) {
+	bkd.queue = q
+}
+
+// SetArchiver gives a copy of each message relayed upstream, with its envelope and the upstream response, to a.
+// Queued messages are archived when they are delivered.
+func (bkd *ProxyBackend) SetArchiver(a MessageArchiver) {
+	bkd.archiver = a
+}
+
+// SetFilters passes each message through filters, in order, before it's relayed or queued. Filters may change
+// the message, or reject it. As a rejection can't be sent part way through relaying, the proxy then answers DATA
+// itself, reading the whole message before sending it upstream.
+func (bkd *ProxyBackend) SetFilters(filters ...MessageFilter) {
+	bkd.filters = filters
+}
+
+// SetMetrics counts upstream connections, responses and messages in m. Give the same Metrics to the Server
+// for the downstream side.
+func (bkd *ProxyBackend) SetMetrics(m *Metrics) {
+	bkd.metrics = m
+}
+
+// SetDKIMSigner signs each message with d, after any filters, so the signature covers the message as relayed or
+// queued. As with filters, the proxy then answers DATA itself.
+func (bkd *ProxyBackend) SetDKIMSigner(d *DKIMSigner) {
+	bkd.signer = d
+}
+
+// SetTransactionLogger passes a record of each mail transaction to l once it ends, whether the message was sent,
+// rejected or abandoned. Messages queued are recorded with the queue's response; their delivery is not.
+func (bkd *ProxyBackend) SetTransactionLogger(l TransactionLogger) {
+	bkd.txnLogger = l
+}
+
+// SetTraceHeaders adds headers to the top of each message received, identifying the transaction as logged.
+// Messages are streamed upstream as before, unless checking for loops. Then the proxy answers DATA itself, and reads
+// the header section before asking the upstream, and BDAT chunks are gathered in memory until the last arrives.
+func (bkd *ProxyBackend) SetTraceHeaders(t *TraceHeaders) {
+	bkd.trace = t
+}
+
+// SetHelloName sets the name the proxy gives in EHLO to upstream servers. By default, a fixed upstream is given
+// its own name, and upstreams chosen by a recipient router, such as MX hosts, are given this host's name.
+func (bkd *ProxyBackend) SetHelloName(name string) {
+	bkd.hello = name
+}
+
+// SetUpstreamInsecureAuth lets the credentials chosen by SetLocalAuth be sent to a remote upstream without TLS.
+// By default they are only sent over TLS, or to this host.
+func (bkd *ProxyBackend) SetUpstreamInsecureAuth(allow bool) {
+	bkd.insecureAuth = allow
+}
+
+// tlsConfig for the upstream connection to addr
+func (bkd *ProxyBackend) tlsConfig(addr string) *tls.Config {
+	host, _, _ := net.SplitHostPort(addr)
+	return &tls.Config{
+		InsecureSkipVerify: bkd.insecureSkipVerify,
+		ServerName:         host,
+	}
+}
+
 func (bkd *ProxyBackend) logger(args ...interface{}) {
 	if bkd.verbose {
 		log.Println(args...)
@@ -68,24 +222,201 @@ func (bkd *ProxyBackend) loggerAlways(args ...interface{}) {
 	log.Println(args...)
 }
 
+// logTag identifies a session, and the transaction if there is one, in log lines
+func logTag(id, txnID string) string {
+	if txnID == "" {
+		return "[" + id + "]"
+	}
+	return "[" + id + "/" + txnID + "]"
+}
+
+// logger and loggerAlways log as the backend does, tagged with the session and transaction IDs
+func (s *proxySession) logger(args ...interface{}) {
+	if s.bkd.verbose {
+		s.bkd.logger(append([]interface{}{logTag(s.id, s.txnID)}, args...)...)
+	}
+}
+
+func (s *proxySession) loggerAlways(args ...interface{}) {
+	s.bkd.loggerAlways(append([]interface{}{logTag(s.id, s.txnID)}, args...)...)
+}
+
 // MakeSession returns a session for this client and backend
 func (bkd *ProxyBackend) MakeSession(c *Client) Session {
+	return bkd.makeSession(c, bkd.outHostPort)
+}
+
+func (bkd *ProxyBackend) makeSession(c *Client, addr string) *proxySession {
 	var s proxySession
 	s.bkd = bkd    // just for logging
 	s.upstream = c // keep record of the upstream Client connection
+	s.addr = addr
+	s.id = newQueueID()
 	return &s
 }
 
 // Init the backend. Here we establish the upstream connection
-func (bkd ProxyBackend) Init() (Session, error) {
-	bkd.logger("---Connecting upstream")
-	c, err := Dial(bkd.outHostPort)
+func (bkd *ProxyBackend) Init() (Session, error) {
+	return bkd.InitContext(context.Background(), ConnectionState{})
+}
+
+// InitContext establishes the upstream connection, chosen for this client if there is a router. If ctx is
+// cancelled, the dial is abandoned, or once connected the upstream connection is closed, unblocking any
+// command in progress.
+func (bkd *ProxyBackend) InitContext(ctx context.Context, state ConnectionState) (Session, error) {
+	from := "unknown"
+	if state.RemoteAddr != nil {
+		from = state.RemoteAddr.String()
+	}
+	tag := logTag(state.SessionID, "")
+	if bkd.queue != nil {
+		bkd.logger(tag, "---Session for", from, ", messages queued")
+		s := bkd.makeSession(nil, "")
+		s.init(ctx, state)
+		s.queue = bkd.queue
+		return s, nil
+	}
+	if bkd.rcptRouter != nil {
+		bkd.logger(tag, "---Session for", from, ", upstream chosen per transaction")
+		s := bkd.makeSession(nil, "")
+		s.init(ctx, state)
+		return s, nil
+	}
+	addrs := []string{bkd.outHostPort}
+	if bkd.router != nil {
+		addr, err := bkd.router(state)
+		if err != nil {
+			bkd.loggerAlways(tag, "< Client", from, "rejected:", err.Error())
+			return nil, err
+		}
+		addrs = []string{addr}
+	} else if bkd.pool != nil {
+		addrs = bkd.pool.Order()
+	}
+	bkd.logger(tag, "---Connecting upstream for", from)
+	c, addr, err := bkd.connect(ctx, addrs, "", bkd.authenticator != nil)
 	if err != nil {
-		bkd.loggerAlways("< Connection error", bkd.outHostPort, err.Error())
 		return nil, err
 	}
-	bkd.logger("< Connection success", bkd.outHostPort)
-	return bkd.MakeSession(c), nil
+	s := bkd.makeSession(c, addr)
+	s.init(ctx, state)
+	return s, nil
+}
+
+// init records the downstream client's connection, taking the session ID from it if given
+func (s *proxySession) init(ctx context.Context, state ConnectionState) {
+	s.ctx = ctx
+	s.state = state
+	s.clientAddr = clientAddr(state)
+	if state.SessionID != "" {
+		s.id = state.SessionID
+	}
+}
+
+// clientAddr returns the downstream client's address, or "" if unknown
+func clientAddr(state ConnectionState) string {
+	if state.RemoteAddr == nil {
+		return ""
+	}
+	return state.RemoteAddr.String()
+}
+
+// connect to the first of addrs that answers, returning the Client and its address. An idle connection from
+// the pool is used if there is one authenticated as authedAs, or as anyone if anyIdentity is set because the
+// client is yet to authenticate locally. Upstreams that can't be reached, or that refuse the greeting or EHLO,
+// are skipped while there are others to try. If the last one connects but rejects EHLO, it's returned anyway so
+// the client sees the upstream's response.
+func (bkd *ProxyBackend) connect(ctx context.Context, addrs []string, authedAs string, anyIdentity bool) (*Client, string, error) {
+	var err error
+	for i, addr := range addrs {
+		if c := bkd.pooledClient(ctx, addr, authedAs, anyIdentity); c != nil {
+			if t := transcriptFrom(ctx); t != nil {
+				t.note("Reusing upstream connection to %s", addr)
+				c.setTranscript(t)
+			}
+			return c, addr, nil
+		}
+		var c *Client
+		start := time.Now()
+		if bkd.upstreamLMTP {
+			c, err = DialLMTPContext(ctx, addr)
+		} else if bkd.upstreamTLS == UpstreamImplicitTLS {
+			c, err = DialTLSContext(ctx, addr, bkd.tlsConfig(addr))
+		} else {
+			c, err = DialContext(ctx, addr)
+		}
+		if err != nil {
+			bkd.metrics.dialed(start, err)
+			bkd.loggerAlways("< Connection error", addr, err.Error())
+			bkd.markDown(addr)
+			if ctx.Err() != nil {
+				return nil, "", err // abandoned, not the upstream's fault
+			}
+			continue
+		}
+		c.AllowInsecureAuth = bkd.insecureAuth
+		if t := transcriptFrom(ctx); t != nil {
+			t.note("Connected upstream to %s: 220 %s", addr, c.greeting)
+			c.setTranscript(t)
+		}
+		code, msg, helloErr := c.Hello(bkd.helloName(addr))
+		bkd.metrics.dialed(start, helloErr)
+		if helloErr != nil {
+			bkd.markDown(addr)
+			if i < len(addrs)-1 {
+				bkd.loggerAlways("< Connection error", addr, code, msg)
+				c.Close()
+				continue
+			}
+		} else if bkd.pool != nil {
+			bkd.pool.MarkUp(addr)
+		}
+		bkd.logger("< Connection success", addr)
+		return c, addr, nil
+	}
+	return nil, "", err
+}
+
+// pooledClient returns an idle connection to addr authenticated as authedAs, or as anyone if anyIdentity is
+// set, if there is one
+func (bkd *ProxyBackend) pooledClient(ctx context.Context, addr, authedAs string, anyIdentity bool) *Client {
+	if bkd.clientPool == nil {
+		return nil
+	}
+	var c *Client
+	if anyIdentity {
+		c = bkd.clientPool.get(ctx, addr, func(string) bool { return true })
+	} else {
+		c = bkd.clientPool.Get(ctx, addr, authedAs)
+	}
+	if c != nil {
+		bkd.logger("< Reusing connection", addr, "used for", c.messages, "messages")
+	}
+	return c
+}
+
+func (bkd *ProxyBackend) markDown(addr string) {
+	if bkd.pool != nil {
+		bkd.pool.MarkDown(addr)
+	}
+}
+
+// helloName is the name the proxy gives in EHLO to the upstream at addr. Giving an MX host its own name would
+// look like spoofing, so upstreams chosen per transaction are given this host's name.
+func (bkd *ProxyBackend) helloName(addr string) string {
+	if bkd.hello != "" {
+		return bkd.hello
+	}
+	if bkd.rcptRouter != nil {
+		if host, err := os.Hostname(); err == nil && host != "" {
+			return host
+		}
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "" {
+		host = "smtpproxy.localhost" // add dummy value in
+	}
+	return host
 }
 
 //-----------------------------------------------------------------------------
@@ -93,8 +424,45 @@ func (bkd ProxyBackend) Init() (Session, error) {
 
 // A Session is returned after successful login. Here hold information that needs to persist across message phases.
 type proxySession struct {
-	bkd      *ProxyBackend // The backend that created this session. Allows session methods to e.g. log
-	upstream *Client       // the upstream client this backend is driving
+	bkd       *ProxyBackend     // The backend that created this session. Allows session methods to e.g. log
+	upstream  *Client           // the upstream client this backend is driving
+	addr      string            // host:port of the upstream
+	sasl      *saslState        // local AUTH exchange in progress
+	authUser  string            // downstream username, once locally authenticated
+	relayAuth bool              // the client has authenticated upstream, through the proxy
+	bdatBytes int64             // size of the message so far, when sent in BDAT chunks
+	bdatStart time.Time         // when the first BDAT chunk was sent
+	noReuse   bool              // the upstream connection can't go back in the pool
+	inData    bool              // the upstream is receiving message data
+	id        string            // identifies the session in logs and transaction records
+	txnID     string            // identifies the current transaction in logs and trace headers
+	traced    bool              // trace headers have been added to the current message
+	state     ConnectionState   // of the downstream connection, as last seen
+	txn       *TransactionEvent // record of the current transaction, if logging them
+
+	ctx context.Context // bounds upstream connections
+
+	// Used when the upstream is chosen per transaction
+	creds       *Credentials // to present upstream, once connected
+	route       string       // the upstreams the current connection was chosen from
+	mailArg     string       // MAIL command argument, held until the upstream is known
+	txnRouted   bool         // MAIL has been sent upstream for the current transaction
+	hasMailFrom bool         // a MAIL command has been accepted for the current transaction
+
+	// Envelope of the current transaction, for queueing or archiving
+	clientAddr string
+	rcptArgs   []string      // RCPT command arguments of accepted recipients
+	bdatBuf    *bytes.Buffer // message so far, when BDAT chunks are gathered before sending on
+	archiveBuf *bytes.Buffer // message so far, when BDAT chunks are copied for archiving
+
+	queue    *Queue // if set, messages are queued rather than relayed
+	delivery bool   // sending a queued message, which was filtered when queued
+}
+
+// saslState tracks an AUTH exchange being handled by the proxy itself
+type saslState struct {
+	mech     string
+	username string // for LOGIN, once received
 }
 
 // cmdTwiddle returns different flow markers depending on whether connection is secure (like Swaks does)
@@ -117,16 +485,37 @@ func respTwiddle(s *proxySession) string {
 	return "\t<-"
 }
 
+// SetState records the state of the downstream connection, for transaction records
+func (s *proxySession) SetState(state ConnectionState) {
+	s.state = state
+}
+
+// Upstream returns the host:port of the upstream server this session is connected to
+func (s *proxySession) Upstream() string {
+	return s.addr
+}
+
 // Greet the upstream host and report capabilities back.
 func (s *proxySession) Greet(helotype string) ([]string, int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), helotype)
-	host, _, _ := net.SplitHostPort(s.bkd.outHostPort)
-	if host == "" {
-		host = "smtpproxy.localhost" // add dummy value in
+	if s.bkd.rcptRouter != nil || s.queue != nil {
+		// A new greeting abandons any transaction in progress
+		if s.txnRouted {
+			s.Passthru(250, "RSET", "")
+		}
+		s.endTransaction()
+		// No upstream to ask yet, so offer what we can handle ourselves
+		caps := []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "STARTTLS"}
+		if s.bkd.authenticator != nil {
+			caps = append(caps, "AUTH PLAIN LOGIN")
+		}
+		return caps, 250, "", nil
 	}
-	code, msg, err := s.upstream.Hello(host)
+	s.endTransaction()
+	s.logger(cmdTwiddle(s), helotype)
+	code, msg, err := s.upstream.Hello(s.bkd.helloName(s.addr))
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), helotype, "error", err.Error())
+		s.loggerAlways(respTwiddle(s), helotype, "error", err.Error())
+		s.noReuse = true
 		if code == 0 {
 			// some errors don't show up in (code,msg) e.g. TLS cert errors, so map as a specific SMTP code/msg response
 			code = 599
@@ -134,112 +523,1041 @@ func (s *proxySession) Greet(helotype string) ([]string, int, string, error) {
 		}
 		return nil, code, msg, err
 	}
-	s.bkd.logger(respTwiddle(s), helotype, "success")
+	s.logger(respTwiddle(s), helotype, "success")
+
+	if _, isTLS := s.upstream.TLSConnectionState(); s.bkd.upstreamTLS == UpstreamStartTLS && !isTLS {
+		if code, msg, err = s.upstreamStartTLS(true); err != nil {
+			return nil, code, msg, err
+		}
+	}
+
 	caps := s.upstream.Capabilities()
-	s.bkd.logger("\tUpstream capabilities:", caps)
+	s.logger("\tUpstream capabilities:", caps)
+	if s.bkd.authenticator != nil {
+		// We offer the mechanisms we can handle locally, whatever the upstream supports
+		local := []string{}
+		for _, c := range caps {
+			if capKeyword(c) != "AUTH" {
+				local = append(local, c)
+			}
+		}
+		caps = append(local, "AUTH PLAIN LOGIN")
+	}
+	if s.bkd.upstreamTLS != UpstreamMirrorTLS {
+		// The proxy handles downstream STARTTLS by itself, so offer it regardless of upstream
+		if ok, _ := s.upstream.Extension("STARTTLS"); !ok {
+			caps = append(caps, "STARTTLS")
+		}
+	}
 	return caps, code, msg, err
 }
 
+// upstreamStartTLS secures the upstream connection, then greets the upstream again. If the upstream doesn't
+// offer STARTTLS, it's an error only if required.
+func (s *proxySession) upstreamStartTLS(required bool) (int, string, error) {
+	if ok, _ := s.upstream.Extension("STARTTLS"); !ok {
+		if !required {
+			return 250, "", nil
+		}
+		msg := "4.7.0 Upstream server does not offer STARTTLS"
+		s.loggerAlways(respTwiddle(s), msg)
+		return 421, msg, errors.New(msg)
+	}
+	cfg := s.bkd.tlsConfig(s.addr)
+	if !required && s.bkd.rcptRouter != nil {
+		// Opportunistic, as in RFC 7435: MX hosts' certificates often don't match their names, and encrypting
+		// without checking is still better than sending in the clear
+		cfg.InsecureSkipVerify = true
+	}
+	s.logger(cmdTwiddle(s), "STARTTLS")
+	code, msg, err := s.upstream.StartTLS(cfg)
+	s.bkd.metrics.tls("upstream", err)
+	if err != nil {
+		s.loggerAlways(respTwiddle(s), code, msg)
+		if code == 0 {
+			code = 599 // the handshake failed, leaving the connection unusable
+			s.noReuse = true
+		}
+		return code, msg, err
+	}
+	s.logger(respTwiddle(s), code, msg)
+	s.logger(cmdTwiddle(s), "EHLO")
+	if code, msg, err = s.upstream.Hello(s.bkd.helloName(s.addr)); err != nil {
+		s.loggerAlways(respTwiddle(s), "EHLO error", err.Error())
+		if code == 0 {
+			code = 599
+			msg = err.Error()
+		}
+		return code, msg, err
+	}
+	s.logger(respTwiddle(s), "EHLO success")
+	return code, msg, nil
+}
+
 // StartTLS command
 func (s *proxySession) StartTLS() (int, string, error) {
-	host, _, _ := net.SplitHostPort(s.bkd.outHostPort)
-	// Try the upstream server, it will report error if unsupported
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: s.bkd.insecureSkipVerify,
-		ServerName:         host,
+	if s.bkd.upstreamTLS != UpstreamMirrorTLS || s.bkd.rcptRouter != nil || s.queue != nil {
+		// Upstream is already as secure as it's going to get, so only the downstream side is upgraded
+		return 220, "2.0.0 Ready to start TLS", nil
 	}
-	s.bkd.logger(cmdTwiddle(s), "STARTTLS")
-	code, msg, err := s.upstream.StartTLS(tlsconfig)
+	// Try the upstream server, it will report error if unsupported
+	s.logger(cmdTwiddle(s), "STARTTLS")
+	code, msg, err := s.upstream.StartTLS(s.bkd.tlsConfig(s.addr))
+	s.bkd.metrics.tls("upstream", err)
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), code, msg)
+		s.loggerAlways(respTwiddle(s), code, msg)
+		if code == 0 {
+			code = 599 // the handshake failed, leaving the connection unusable
+			s.noReuse = true
+		}
 	} else {
-		s.bkd.logger(respTwiddle(s), code, msg)
+		s.logger(respTwiddle(s), code, msg)
 	}
 	return code, msg, err
 }
 
 //Auth command backend handler
 func (s *proxySession) Auth(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	if s.bkd.authenticator == nil {
+		if s.bkd.rcptRouter != nil || s.queue != nil {
+			return 502, "5.5.1 AUTH not available", nil
+		}
+		s.noReuse = true // the connection now belongs to this client
+		code, msg, err := s.Passthru(expectcode, cmd, arg)
+		if code == 235 {
+			s.relayAuth = true
+		}
+		return code, msg, err
+	}
+	if s.sasl == nil {
+		return s.authStart(arg)
+	}
+	// Continuation lines arrive in place of the command
+	return s.authContinue(cmd)
+}
+
+// authStart begins a local AUTH exchange
+func (s *proxySession) authStart(arg string) (int, string, error) {
+	if s.authUser != "" {
+		return 503, "5.5.1 Already authenticated", nil
+	}
+	args := strings.Fields(arg)
+	if len(args) == 0 {
+		return 501, "5.5.4 Missing mechanism", nil
+	}
+	s.sasl = &saslState{mech: strings.ToUpper(args[0])}
+	switch s.sasl.mech {
+	case "PLAIN":
+		if len(args) > 1 {
+			return s.authContinue(args[1])
+		}
+		return 334, "", nil
+	case "LOGIN":
+		if len(args) > 1 {
+			return s.authContinue(args[1])
+		}
+		return 334, base64.StdEncoding.EncodeToString([]byte("Username:")), nil
+	}
+	s.sasl = nil
+	return 504, "5.5.4 Unrecognized authentication type", nil
+}
+
+// authContinue handles each base64 line of a local AUTH exchange
+func (s *proxySession) authContinue(line string) (int, string, error) {
+	if line == "*" {
+		s.sasl = nil
+		return 501, "5.0.0 Authentication cancelled", nil
+	}
+	var resp []byte
+	if line != "=" { // "=" is an empty response
+		var err error
+		if resp, err = base64.StdEncoding.DecodeString(line); err != nil {
+			s.sasl = nil
+			return 501, "5.5.2 Invalid base64 data", nil
+		}
+	}
+	switch s.sasl.mech {
+	case "PLAIN":
+		// authorization identity, authentication identity and password, NUL separated
+		parts := strings.Split(string(resp), "\x00")
+		if len(parts) != 3 {
+			s.sasl = nil
+			return 501, "5.5.2 Invalid PLAIN response", nil
+		}
+		// Acting on behalf of another user isn't supported (RFC 4616 section 2)
+		if parts[0] != "" && parts[0] != parts[1] {
+			s.sasl = nil
+			s.loggerAlways("AUTH failed for user", parts[1], "can't act as", parts[0])
+			return 535, "5.7.8 Authentication credentials invalid", nil
+		}
+		return s.authVerify(parts[1], parts[2])
+	case "LOGIN":
+		if s.sasl.username == "" {
+			s.sasl.username = string(resp)
+			return 334, base64.StdEncoding.EncodeToString([]byte("Password:")), nil
+		}
+		return s.authVerify(s.sasl.username, string(resp))
+	}
+	return 0, "", nil // can't happen, mechanism was checked in authStart
+}
+
+// authVerify checks the client credentials, then authenticates upstream with those chosen for this client
+func (s *proxySession) authVerify(username, password string) (int, string, error) {
+	s.sasl = nil
+	if err := s.bkd.authenticator.Authenticate(username, password); err != nil {
+		s.loggerAlways("AUTH failed for user", username, err.Error())
+		return 535, "5.7.8 Authentication credentials invalid", nil
+	}
+	var creds *Credentials
+	if s.bkd.credentials != nil {
+		var err error
+		if creds, err = s.bkd.credentials(username); err != nil {
+			s.loggerAlways("AUTH credentials lookup error for user", username, err.Error())
+			return 454, "4.7.0 Temporary authentication failure", nil
+		}
+	}
+	if s.queue != nil {
+		// Credentials are looked up again when the message is delivered
+	} else if s.bkd.rcptRouter != nil {
+		s.creds = creds // presented once the upstream is known
+	} else if err := s.authUpstream(creds, username); err != nil {
+		return 454, "4.7.0 Temporary authentication failure", nil
+	}
+	s.authUser = username
+	return 235, "2.7.0 Authentication successful", nil
+}
+
+// authUpstream makes sure the upstream connection is authenticated with creds, or not at all if creds is nil,
+// on behalf of a locally authenticated user. A pooled connection may be swapped in, to save authenticating.
+func (s *proxySession) authUpstream(creds *Credentials, username string) error {
+	want := ""
+	if creds != nil {
+		want = creds.Username
+	}
+	if s.upstream.authedAs == want {
+		return nil
+	}
+	var c *Client
+	if want != "" {
+		c = s.bkd.pooledClient(s.ctx, s.addr, want, false)
+	}
+	fresh := false
+	if c == nil && s.upstream.authedAs != "" {
+		// This pooled connection was authenticated for someone else, so start afresh
+		var err error
+		if c, _, err = s.bkd.connect(s.ctx, []string{s.addr}, "", false); err != nil {
+			return err
+		}
+		fresh = true
+	}
+	if c != nil {
+		_, wasTLS := s.upstream.TLSConnectionState()
+		s.releaseUpstream()
+		s.upstream = c
+		s.noReuse, s.inData = false, false
+		if _, isTLS := c.TLSConnectionState(); fresh && !isTLS && (wasTLS || s.bkd.upstreamTLS == UpstreamStartTLS) {
+			// Secured as the connection it replaces was, before the credentials are sent. As on connecting, it's
+			// opportunistic for upstreams chosen per transaction.
+			required := s.bkd.upstreamTLS == UpstreamStartTLS || s.bkd.rcptRouter == nil
+			if _, _, err := s.upstreamStartTLS(required); err != nil {
+				return err
+			}
+		}
+	}
+	if s.upstream.authedAs == want {
+		return nil
+	}
+	s.logger(cmdTwiddle(s), "AUTH as", creds.Username, "on behalf of", username)
+	code, msg, err := s.upstream.Auth(creds.Username, creds.Password)
+	if err != nil {
+		s.loggerAlways(respTwiddle(s), "AUTH", code, msg, "error", err.Error())
+		return err
+	}
+	s.logger(respTwiddle(s), code, msg)
+	return nil
 }
 
 //Mail command backend handler
-func (s *proxySession) Mail(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+func (s *proxySession) Mail(expectcode int, cmd, arg string) (code int, msg string, err error) {
+	defer func() { s.mailAccepted(arg, code) }()
+	if s.bkd.authenticator != nil && s.authUser == "" {
+		return 530, "5.7.0 Authentication required", nil
+	}
+	if s.bkd.rcptRouter != nil || s.queue != nil {
+		return s.holdMail(arg)
+	}
+	code, msg, err = s.Passthru(expectcode, cmd, arg)
+	if err == nil && code2xxSuccess(code) {
+		s.mailArg = arg
+	}
+	return code, msg, err
 }
 
 //Rcpt command backend handler
-func (s *proxySession) Rcpt(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+func (s *proxySession) Rcpt(expectcode int, cmd, arg string) (code int, msg string, err error) {
+	defer func() { s.txnRcpt(arg, code, msg) }()
+	if s.queue != nil {
+		return s.queueRcpt(arg)
+	}
+	if s.bkd.rcptRouter != nil {
+		if code, msg, err := s.routeRcpt(arg); err != nil || !code2xxSuccess(code) {
+			return code, msg, err
+		}
+	}
+	code, msg, err = s.Passthru(expectcode, cmd, arg)
+	if err == nil && code2xxSuccess(code) {
+		s.rcptArgs = append(s.rcptArgs, arg)
+	}
+	return code, msg, err
 }
 
 //Reset command backend handler
 func (s *proxySession) Reset(expectcode int, cmd, arg string) (int, string, error) {
+	s.bdatBytes = 0
+	s.endTransaction()
+	if s.upstream == nil {
+		return 250, "2.0.0 OK", nil
+	}
 	return s.Passthru(expectcode, cmd, arg)
 }
 
-//Quit command backend handler
+//Quit command backend handler. The upstream connection is closed afterwards, whatever the response,
+// unless it's kept for reuse
 func (s *proxySession) Quit(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	s.endTransaction()
+	if s.upstream == nil {
+		return 221, "2.0.0 Bye", nil
+	}
+	return s.releaseUpstream()
+}
+
+// releaseUpstream gives up the upstream connection, returning it to the pool if it can be reused, otherwise
+// sending QUIT and closing it
+func (s *proxySession) releaseUpstream() (int, string, error) {
+	c := s.upstream
+	s.upstream = nil
+	if s.bkd.clientPool != nil && !s.noReuse && !s.inData {
+		if _, isTLS := c.TLSConnectionState(); !isTLS || s.bkd.upstreamTLS != UpstreamMirrorTLS {
+			s.logger("---Keeping connection", s.addr, "for reuse")
+			c.setTranscript(nil)
+			s.bkd.clientPool.Put(s.addr, c)
+			return 221, "2.0.0 Bye", nil
+		}
+	}
+	s.upstream = c // for logging
+	code, msg, err := s.Passthru(221, "QUIT", "")
+	c.Close()
+	s.upstream = nil
+	return code, msg, err
 }
 
 //Unknown command backend handler
 func (s *proxySession) Unknown(expectcode int, cmd, arg string) (int, string, error) {
+	if s.upstream != nil && s.upstream.authedAs != "" && s.authUser == "" {
+		return 530, "5.7.0 Authentication required", nil // a pooled connection, authenticated for someone else
+	}
+	if s.upstream == nil {
+		if cmd == "NOOP" {
+			return 250, "2.0.0 OK", nil
+		}
+		return 502, "5.5.1 Command not implemented", nil
+	}
 	return s.Passthru(expectcode, cmd, arg)
 }
 
+// holdMail accepts MAIL FROM, to be sent on once the upstream for this transaction is known
+func (s *proxySession) holdMail(arg string) (int, string, error) {
+	if s.hasMailFrom {
+		return 503, "5.5.1 Sender already specified", nil
+	}
+	if _, ok := parsePath(arg, "FROM:"); !ok {
+		return 501, "5.5.4 Syntax: MAIL FROM:<address>", nil
+	}
+	s.logger("\tMAIL held until upstream is chosen", arg)
+	s.mailArg = arg
+	s.hasMailFrom = true
+	return 250, "2.1.0 Sender OK", nil
+}
+
+// queueRcpt accepts a recipient for a queued message. With a recipient router, recipients it refuses are
+// refused now, rather than bounced later.
+func (s *proxySession) queueRcpt(arg string) (int, string, error) {
+	if !s.hasMailFrom {
+		return 503, "5.5.1 Need MAIL before RCPT", nil
+	}
+	rcpt, ok := parsePath(arg, "TO:")
+	if !ok {
+		return 501, "5.5.4 Syntax: RCPT TO:<address>", nil
+	}
+	if s.bkd.rcptRouter != nil {
+		from, _ := parsePath(s.mailArg, "FROM:")
+		if _, err := s.bkd.rcptRouter(s.ctx, from, rcpt); err != nil {
+			s.loggerAlways("< Recipient", rcpt, "not routed:", err.Error())
+			if smtpErr, ok := err.(*SMTPError); ok {
+				return smtpErr.Code, enhancedMsg(smtpErr), nil
+			}
+			return 451, "4.4.0 Unable to route recipient", nil
+		}
+	}
+	s.rcptArgs = append(s.rcptArgs, arg)
+	return 250, "2.1.5 Recipient OK", nil
+}
+
+// routeRcpt chooses the upstream for a recipient. The first recipient of a transaction picks the upstream,
+// connecting if necessary, and the held MAIL command is sent on. Later recipients that would go elsewhere are
+// deferred. A 2xx code means the RCPT command can be passed upstream.
+func (s *proxySession) routeRcpt(arg string) (int, string, error) {
+	if !s.hasMailFrom {
+		return 503, "5.5.1 Need MAIL before RCPT", nil
+	}
+	rcpt, ok := parsePath(arg, "TO:")
+	if !ok {
+		return 501, "5.5.4 Syntax: RCPT TO:<address>", nil
+	}
+	from, _ := parsePath(s.mailArg, "FROM:")
+	addrs, err := s.bkd.rcptRouter(s.ctx, from, rcpt)
+	if err != nil {
+		s.loggerAlways("< Recipient", rcpt, "not routed:", err.Error())
+		if smtpErr, ok := err.(*SMTPError); ok {
+			return smtpErr.Code, enhancedMsg(smtpErr), nil
+		}
+		return 451, "4.4.0 Unable to route recipient", nil
+	}
+	route := strings.Join(addrs, ",")
+	if s.txnRouted {
+		if route != s.route {
+			return 452, "4.5.3 Recipient routed to a different upstream, send it in a separate transaction", nil
+		}
+		return 250, "", nil
+	}
+
+	if s.upstream == nil || route != s.route {
+		if code, msg, err := s.connectUpstream(addrs); err != nil {
+			return code, msg, nil // the client can continue, perhaps with other recipients
+		}
+		s.route = route
+	}
+	code, msg, err := s.Passthru(250, "MAIL", s.mailArg)
+	if err != nil {
+		return code, msg, nil
+	}
+	s.txnRouted = true
+	return code, msg, nil
+}
+
+// connectUpstream replaces any existing upstream connection with one to the first of addrs that answers,
+// securing and authenticating it as configured
+func (s *proxySession) connectUpstream(addrs []string) (int, string, error) {
+	if s.upstream != nil {
+		s.releaseUpstream()
+		s.route = ""
+	}
+	authedAs := ""
+	if s.creds != nil {
+		authedAs = s.creds.Username
+	}
+	c, addr, err := s.bkd.connect(s.ctx, addrs, authedAs, false)
+	if err != nil {
+		return 451, "4.4.1 Unable to connect to upstream server", err
+	}
+	s.upstream, s.addr = c, addr
+	s.noReuse, s.inData = false, false
+	if code, msg, err := c.Hello(s.bkd.helloName(addr)); err != nil {
+		if code == 0 {
+			code = 599
+			msg = err.Error()
+		}
+		return s.dropUpstream(code, msg, err)
+	}
+	if _, isTLS := c.TLSConnectionState(); s.bkd.upstreamTLS != UpstreamPlain && !isTLS {
+		if code, msg, err := s.upstreamStartTLS(s.bkd.upstreamTLS == UpstreamStartTLS); err != nil {
+			return s.dropUpstream(code, msg, err)
+		}
+	}
+	if s.bkd.authenticator != nil {
+		if err := s.authUpstream(s.creds, s.authUser); err != nil {
+			return s.dropUpstream(454, "4.7.0 Temporary authentication failure", err)
+		}
+	}
+	return 250, "", nil
+}
+
+// dropUpstream closes an upstream connection that couldn't be set up, passing on the reason
+func (s *proxySession) dropUpstream(code int, msg string, err error) (int, string, error) {
+	s.upstream.Close()
+	s.upstream = nil
+	return code, msg, err
+}
+
+// mailAccepted starts a new transaction, if MAIL was accepted
+func (s *proxySession) mailAccepted(arg string, code int) {
+	if !code2xxSuccess(code) {
+		return
+	}
+	s.txnID = newQueueID()
+	s.traced = false
+	s.txnMail(arg)
+}
+
+// endTransaction forgets the envelope of the current transaction, after logging it
+func (s *proxySession) endTransaction() {
+	if s.txn != nil {
+		s.txnLog()
+	}
+	s.txnID = ""
+	s.traced = false
+	s.mailArg = ""
+	s.hasMailFrom = false
+	s.txnRouted = false
+	s.rcptArgs = nil
+	s.bdatBuf = nil
+	s.archiveBuf = nil
+}
+
+// enhancedMsg formats an SMTPError message with its enhanced status code, as session methods return them
+func enhancedMsg(err *SMTPError) string {
+	if err.EnhancedCode == NoEnhancedCode || err.EnhancedCode == EnhancedCodeNotSet {
+		return err.Message
+	}
+	return fmt.Sprintf("%d.%d.%d %s", err.EnhancedCode[0], err.EnhancedCode[1], err.EnhancedCode[2], err.Message)
+}
+
 // Passthru a command to the upstream server, logging
 func (s *proxySession) Passthru(expectcode int, cmd, arg string) (int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), cmd, arg)
+	s.logger(cmdTwiddle(s), cmd, arg)
 	joined := cmd
 	if arg != "" {
 		joined = cmd + " " + arg
 	}
-	code, msg, err := s.upstream.MyCmd(expectcode, joined)
+	code, msg, err := s.upstream.MyCmd(expectcode, "%s", joined)
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), cmd, code, msg, "error", err.Error())
+		s.loggerAlways(respTwiddle(s), cmd, code, msg, "error", err.Error())
 		if code == 0 {
 			// some errors don't show up in (code,msg) e.g. TLS cert errors, so map as a specific SMTP code/msg response
 			code = 599
 			msg = err.Error()
+			s.noReuse = true
 		}
 	} else {
-		s.bkd.logger(respTwiddle(s), code, msg)
+		s.logger(respTwiddle(s), code, msg)
 	}
+	s.bkd.metrics.response(cmd, code)
 	return code, msg, err
 }
 
+// Pipeline passes a group of commands upstream without waiting for each response, if the upstream
+// supports PIPELINING. Otherwise they are sent one at a time.
+func (s *proxySession) Pipeline(cmds []Command) []Response {
+	resps := make([]Response, len(cmds))
+	if s.upstream == nil || s.bkd.rcptRouter != nil {
+		// Nothing to pipeline to yet
+		for i, cmd := range cmds {
+			resps[i].Code, resps[i].Msg, _ = s.sessionFunc(cmd.Cmd)(0, cmd.Cmd, cmd.Arg)
+		}
+		return resps
+	}
+	if ok, _ := s.upstream.Extension("PIPELINING"); !ok {
+		for i, cmd := range cmds {
+			resps[i].Code, resps[i].Msg, _ = s.sessionFunc(cmd.Cmd)(0, cmd.Cmd, cmd.Arg)
+		}
+		return resps
+	}
+
+	// Some commands may be answered by us, rather than the upstream server
+	lines := []string{}
+	upstreamIdx := []int{}
+	for i, cmd := range cmds {
+		if cmd.Cmd == "MAIL" && s.bkd.authenticator != nil && s.authUser == "" {
+			resps[i] = Response{Code: 530, Msg: "5.7.0 Authentication required"}
+			continue
+		}
+		line := cmd.Cmd
+		if cmd.Arg != "" {
+			line += " " + cmd.Arg
+		}
+		s.logger(cmdTwiddle(s), cmd.Cmd, cmd.Arg)
+		lines = append(lines, line)
+		upstreamIdx = append(upstreamIdx, i)
+	}
+
+	upResps, err := s.upstream.Pipeline(lines)
+	for j, i := range upstreamIdx {
+		if j < len(upResps) {
+			resps[i] = upResps[j]
+			s.logger(respTwiddle(s), resps[i].Code, resps[i].Msg)
+			s.bkd.metrics.response(cmds[i].Cmd, resps[i].Code)
+			s.trackEnvelope(cmds[i], resps[i].Code, resps[i].Msg)
+		} else {
+			// map errors that don't show up in (code,msg) as a specific SMTP code/msg response, as Passthru does
+			resps[i] = Response{Code: 599, Msg: err.Error()}
+		}
+	}
+	if err != nil {
+		s.loggerAlways(respTwiddle(s), "pipeline error", err.Error())
+		s.noReuse = true
+	}
+	return resps
+}
+
+// trackEnvelope records the effect of a pipelined command on the envelope of the current transaction
+func (s *proxySession) trackEnvelope(cmd Command, code int, msg string) {
+	switch cmd.Cmd {
+	case "MAIL":
+		s.mailAccepted(cmd.Arg, code)
+	case "RCPT":
+		s.txnRcpt(cmd.Arg, code, msg)
+	}
+	if !code2xxSuccess(code) {
+		return
+	}
+	switch cmd.Cmd {
+	case "MAIL":
+		s.mailArg = cmd.Arg
+	case "RCPT":
+		s.rcptArgs = append(s.rcptArgs, cmd.Arg)
+	case "RSET":
+		s.endTransaction()
+	}
+}
+
+// sessionFunc returns the handler for a pipelinable command
+func (s *proxySession) sessionFunc(cmd string) SessionFunc {
+	switch cmd {
+	case "MAIL":
+		return s.Mail
+	case "RCPT":
+		return s.Rcpt
+	case "RSET":
+		return s.Reset
+	}
+	return s.Unknown
+}
+
 // DataCommand pass upstream, returning a place to write the data AND the usual responses
 func (s *proxySession) DataCommand() (io.WriteCloser, int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), "DATA")
+	if s.queue != nil || s.filtering() || s.checkingHops() {
+		if len(s.rcptArgs) == 0 {
+			msg := "5.5.1 No valid recipients"
+			return nil, 503, msg, errors.New(msg)
+		}
+		// The message is read before it's queued or sent upstream, in Data
+		return nil, 354, "Start mail input; end with <CRLF>.<CRLF>", nil
+	}
+	if s.upstream == nil || (s.bkd.rcptRouter != nil && !s.txnRouted) {
+		msg := "5.5.1 No valid recipients"
+		return nil, 503, msg, errors.New(msg)
+	}
+	w, code, msg, err := s.upstreamData()
+	if err != nil {
+		// The client's transaction ends here, so its envelope mustn't carry over to the next
+		s.txnResult("DATA", 0, code, msg, err)
+		s.endTransaction()
+	}
+	return w, code, msg, err
+}
+
+// upstreamData sends DATA upstream, returning a place to write the message
+func (s *proxySession) upstreamData() (io.WriteCloser, int, string, error) {
+	s.logger(cmdTwiddle(s), "DATA")
 	w, code, msg, err := s.upstream.Data()
+	s.bkd.metrics.response("DATA", code)
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), "DATA error", err.Error())
+		s.loggerAlways(respTwiddle(s), "DATA error", err.Error())
+		if code == 0 {
+			s.noReuse = true
+		}
+	} else {
+		s.inData = true
 	}
 	return w, code, msg, err
 }
 
 // Data body (dot delimited) pass upstream, returning the usual responses
-func (s *proxySession) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
+func (s *proxySession) Data(r io.Reader, w io.WriteCloser) (code int, msg string, err error) {
+	defer s.endTransaction()
+	cr := &countingReader{r: r}
+	r = cr
+	defer func() { s.txnResult("DATA", cr.n, code, msg, err) }()
+	if s.checkingHops() {
+		if r, code, msg, err = s.checkHops(r); err != nil {
+			return code, msg, err
+		}
+	}
+	if hdr := s.traceHeaders("\n"); hdr != "" {
+		r = io.MultiReader(strings.NewReader(hdr), r)
+	}
+	if s.filtering() {
+		filtered, code, msg, err := s.filter(r)
+		if err != nil {
+			return code, msg, err
+		}
+		r = filtered
+	}
+	if s.queue != nil {
+		return s.enqueue(r, "DATA") // archived when delivered
+	}
+	if w == nil {
+		// The proxy answered DATA itself, so the upstream is yet to be asked
+		if w, code, msg, err = s.upstreamData(); err != nil {
+			if code == 0 {
+				code = 599
+				msg = err.Error()
+			}
+			return code, msg, err
+		}
+	}
+	if s.bkd.archiver == nil {
+		return s.data(r, w)
+	}
+	var buf bytes.Buffer
+	code, msg, err = s.data(io.TeeReader(r, &buf), w)
+	s.archive(&buf, code, msg)
+	return code, msg, err
+}
+
+// data sends the message upstream
+func (s *proxySession) data(r io.Reader, w io.WriteCloser) (int, string, error) {
 	// Send the data upstream
+	start := time.Now()
 	count, err := io.Copy(w, r)
 	if err != nil {
 		msg := "DATA io.Copy error"
-		s.bkd.loggerAlways(respTwiddle(s), msg, err.Error())
+		s.loggerAlways(respTwiddle(s), msg, err.Error())
 		return 0, msg, err
 	}
 	err = w.Close() // Need to close the data phase - then we should have response from upstream
 	code := s.upstream.DataResponseCode
 	msg := s.upstream.DataResponseMsg
+	if code != 0 {
+		s.inData = false // the upstream has responded, so is ready for more
+	}
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), "DATA Close error", err, ", bytes written =", count)
+		s.loggerAlways(respTwiddle(s), "DATA Close error", err, ", bytes written =", count)
 		return 0, msg, err
 	}
+	s.bkd.metrics.message("DATA", count, start, code)
 	if s.bkd.verbose {
-		s.bkd.logger(respTwiddle(s), "DATA accepted, bytes written =", count)
+		s.logger(respTwiddle(s), "DATA accepted, bytes written =", count)
 	} else {
 		// Short-form logging - one line per message - used when "verbose" not set
-		log.Printf("Message DATA upstream,%d,%d,%s\n", count, code, msg)
+		log.Printf("%s Message DATA upstream,%d,%d,%s\n", logTag(s.id, s.txnID), count, code, msg)
 	}
 	return code, msg, err
 }
+
+// filtering reports whether messages in this session go through the backend's filters or signer
+func (s *proxySession) filtering() bool {
+	return (len(s.bkd.filters) > 0 || s.bkd.signer != nil) && !s.delivery
+}
+
+// filter passes the message through the backend's filters, then the signer. If it's rejected, the reason is
+// returned as an error, and any transaction upstream is reset.
+func (s *proxySession) filter(r io.Reader) (*bytes.Buffer, int, string, error) {
+	filters := s.bkd.filters
+	if s.bkd.signer != nil {
+		filters = append(filters[:len(filters):len(filters)], s.bkd.signer)
+	}
+	out, err := FilterMessage(s.envelope(0, ""), r, filters...)
+	if err == nil {
+		return out, 0, "", nil
+	}
+	s.loggerAlways("Message rejected by filter:", err.Error())
+	s.resetUpstream()
+	if smtpErr, ok := err.(*SMTPError); ok {
+		return nil, smtpErr.Code, enhancedMsg(smtpErr), err
+	}
+	return nil, 451, "4.3.0 Message filter error", err
+}
+
+// resetUpstream abandons the transaction upstream, when the proxy rejects a message before sending it
+func (s *proxySession) resetUpstream() {
+	if s.upstream != nil {
+		s.upstream.DataResponses = nil // so that LMTP clients get the rejection for every recipient
+		s.Passthru(250, "RSET", "")
+	}
+}
+
+// envelope of the current transaction, with the upstream response if known
+func (s *proxySession) envelope(code int, text string) *Envelope {
+	env := &Envelope{
+		ClientAddr: s.clientAddr,
+		Upstream:   s.addr,
+		Code:       code,
+		Msg:        text,
+		Time:       time.Now(),
+	}
+	env.MailFrom, _ = parsePath(s.mailArg, "FROM:")
+	for _, arg := range s.rcptArgs {
+		rcpt, _ := parsePath(arg, "TO:")
+		env.RcptTo = append(env.RcptTo, rcpt)
+	}
+	return env
+}
+
+// archive gives a copy of the message to the archiver, if the upstream responded to it
+func (s *proxySession) archive(msg *bytes.Buffer, code int, text string) {
+	if code == 0 {
+		return // the message didn't get through
+	}
+	if err := s.bkd.archiver.Archive(s.envelope(code, text), msg); err != nil {
+		s.loggerAlways("Message archive error", err.Error())
+	}
+}
+
+// enqueue stores the message read from r in the queue, with the envelope of the current transaction
+func (s *proxySession) enqueue(r io.Reader, cmd string) (int, string, error) {
+	msg := &QueuedMessage{
+		ID:         s.txnID,
+		MailArg:    s.mailArg,
+		RcptArgs:   s.rcptArgs,
+		AuthUser:   s.authUser,
+		ClientAddr: s.clientAddr,
+	}
+	count, err := s.queue.Enqueue(msg, r)
+	if err != nil {
+		s.loggerAlways("Message", cmd, "queue error", err.Error())
+		return 451, "4.3.0 Unable to queue message", err
+	}
+	if s.bkd.verbose {
+		s.logger("Message", cmd, "queued as", msg.ID, ", bytes written =", count)
+	} else {
+		// Short-form logging - one line per message - used when "verbose" not set
+		log.Printf("%s Message %s queued,%d,%s\n", logTag(s.id, s.txnID), cmd, count, msg.ID)
+	}
+	return 250, "2.0.0 Queued as " + msg.ID, nil
+}
+
+// LMTPResponses returns the upstream LMTP server's response for each recipient of the last message.
+// Returns nil if the upstream server speaks SMTP.
+func (s *proxySession) LMTPResponses() []Response {
+	if s.upstream == nil || !s.upstream.lmtp {
+		return nil
+	}
+	return s.upstream.DataResponses
+}
+
+// Bdat passes a chunk of the message upstream
+func (s *proxySession) Bdat(size int64, last bool, r io.Reader) (int, string, error) {
+	if s.txn != nil {
+		s.txn.Size += size
+	}
+	if s.queue != nil || s.filtering() || s.checkingHops() {
+		return s.bufferBdat(size, last, r)
+	}
+	if !s.traced {
+		// Added to the first chunk
+		s.traced = true
+		if hdr := s.traceHeaders("\r\n"); hdr != "" {
+			r = io.MultiReader(strings.NewReader(hdr), r)
+			size += int64(len(hdr))
+		}
+	}
+	if s.upstream == nil || (s.bkd.rcptRouter != nil && !s.txnRouted) {
+		msg := "5.5.1 No valid recipients"
+		return 503, msg, errors.New(msg)
+	}
+	return s.bdatUpstream(size, last, r)
+}
+
+// bdatUpstream passes a chunk upstream
+func (s *proxySession) bdatUpstream(size int64, last bool, r io.Reader) (int, string, error) {
+	s.logger(cmdTwiddle(s), "BDAT", size, last)
+	if s.bkd.archiver != nil {
+		if s.archiveBuf == nil {
+			s.archiveBuf = new(bytes.Buffer)
+		}
+		r = io.TeeReader(r, s.archiveBuf)
+	}
+	if s.bdatBytes == 0 {
+		s.bdatStart = time.Now()
+	}
+	code, msg, err := s.upstream.Bdat(size, last, r)
+	if last && s.bkd.archiver != nil {
+		s.archive(s.archiveBuf, code, msg)
+	}
+	if last || err != nil {
+		s.txnResult("BDAT", 0, code, msg, err)
+		defer s.endTransaction() // after logging
+	}
+	if err != nil {
+		s.loggerAlways(respTwiddle(s), "BDAT", code, msg, "error", err.Error())
+		if code == 0 {
+			// some errors don't show up in (code,msg) e.g. TLS cert errors, so map as a specific SMTP code/msg response
+			code = 599
+			msg = err.Error()
+			s.noReuse = true
+		}
+		s.bkd.metrics.response("BDAT", code)
+		s.bdatBytes = 0
+		return code, msg, err
+	}
+	s.bdatBytes += size
+	if last {
+		s.bkd.metrics.message("BDAT", s.bdatBytes, s.bdatStart, code)
+		if s.bkd.verbose {
+			s.logger(respTwiddle(s), "BDAT accepted, bytes written =", s.bdatBytes)
+		} else {
+			// Short-form logging - one line per message - used when "verbose" not set
+			log.Printf("%s Message BDAT upstream,%d,%d,%s\n", logTag(s.id, s.txnID), s.bdatBytes, code, msg)
+		}
+		s.bdatBytes = 0
+	} else {
+		s.bkd.metrics.response("BDAT", code)
+		s.logger(respTwiddle(s), code, msg)
+	}
+	return code, msg, err
+}
+
+// bufferBdat gathers BDAT chunks in memory. Once the last arrives, the whole message is checked for loops and
+// filtered, then queued or sent upstream as a single chunk.
+func (s *proxySession) bufferBdat(size int64, last bool, r io.Reader) (code int, text string, err error) {
+	if len(s.rcptArgs) == 0 {
+		msg := "5.5.1 No valid recipients"
+		return 503, msg, errors.New(msg)
+	}
+	if s.bdatBuf == nil {
+		s.bdatBuf = new(bytes.Buffer)
+	}
+	if _, err := io.CopyN(s.bdatBuf, r, size); err != nil {
+		s.txnResult("BDAT", 0, 0, "BDAT read error", err)
+		s.endTransaction()
+		return 0, "BDAT read error", err
+	}
+	if !last {
+		return 250, fmt.Sprintf("2.0.0 %d octets received", size), nil
+	}
+	defer s.endTransaction()
+	defer func() { s.txnResult("BDAT", 0, code, text, err) }()
+	var msg io.Reader = s.bdatBuf
+	msgSize := int64(s.bdatBuf.Len())
+	if s.checkingHops() {
+		if msg, code, text, err = s.checkHops(msg); err != nil {
+			return code, text, err
+		}
+	}
+	if hdr := s.traceHeaders("\r\n"); hdr != "" {
+		msg = io.MultiReader(strings.NewReader(hdr), msg)
+		msgSize += int64(len(hdr))
+	}
+	if s.filtering() {
+		filtered, code, text, err := s.filter(msg)
+		if err != nil {
+			return code, text, err
+		}
+		msg, msgSize = filtered, int64(filtered.Len())
+	}
+	if s.queue != nil {
+		return s.enqueue(msg, "BDAT")
+	}
+	return s.bdatUpstream(msgSize, true, msg)
+}
+
+// Deliver sends a queued message upstream, for use with Queue.Run. Recipients are grouped by the upstreams
+// the recipient router chooses for them, if set, and each group sent as a separate transaction.
+func (bkd *ProxyBackend) Deliver(ctx context.Context, msg *QueuedMessage, body io.ReadSeeker) []Response {
+	resps := make([]Response, len(msg.RcptArgs))
+	from, _ := parsePath(msg.MailArg, "FROM:")
+	var routes []string
+	groups := make(map[string][]int) // recipient indexes by route
+	for i, arg := range msg.RcptArgs {
+		addrs := []string{bkd.outHostPort}
+		if bkd.rcptRouter != nil {
+			rcpt, _ := parsePath(arg, "TO:")
+			var err error
+			if addrs, err = bkd.rcptRouter(ctx, from, rcpt); err != nil {
+				resps[i] = Response{Code: 451, Msg: "4.4.0 Unable to route recipient"}
+				if smtpErr, ok := err.(*SMTPError); ok {
+					resps[i] = Response{Code: smtpErr.Code, Msg: enhancedMsg(smtpErr)}
+				}
+				continue
+			}
+		} else if bkd.pool != nil {
+			addrs = bkd.pool.Order()
+		}
+		route := strings.Join(addrs, ",")
+		if _, ok := groups[route]; !ok {
+			routes = append(routes, route)
+		}
+		groups[route] = append(groups[route], i)
+	}
+	for _, route := range routes {
+		idx := groups[route]
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			for _, i := range idx {
+				resps[i] = Response{Code: 451, Msg: "4.3.0 " + err.Error()}
+			}
+			continue
+		}
+		bkd.deliverTo(ctx, msg, strings.Split(route, ","), idx, body, resps)
+	}
+	return resps
+}
+
+// deliverTo sends a queued message to the recipients at indexes idx, via the first of addrs that answers,
+// filling in their responses
+func (bkd *ProxyBackend) deliverTo(ctx context.Context, msg *QueuedMessage, addrs []string, idx []int, body io.Reader, resps []Response) {
+	fail := func(code int, text string) {
+		for _, i := range idx {
+			if resps[i].Code == 0 {
+				resps[i] = Response{Code: code, Msg: text}
+			}
+		}
+	}
+	bkd.logger("---Delivering queued message", msg.ID, "to", len(idx), "recipients")
+	s := bkd.makeSession(nil, "")
+	s.ctx = ctx
+	s.authUser = msg.AuthUser
+	s.clientAddr = msg.ClientAddr
+	s.txnID = msg.ID
+	s.delivery = true
+	if bkd.credentials != nil && msg.AuthUser != "" {
+		var err error
+		if s.creds, err = bkd.credentials(msg.AuthUser); err != nil {
+			bkd.loggerAlways("AUTH credentials lookup error for user", msg.AuthUser, err.Error())
+			fail(454, "4.7.0 Temporary authentication failure")
+			return
+		}
+	}
+	if code, text, err := s.connectUpstream(addrs); err != nil {
+		fail(code, text)
+		return
+	}
+	defer s.releaseUpstream()
+	if code, text, err := s.Passthru(250, "MAIL", msg.MailArg); err != nil {
+		fail(code, text)
+		return
+	}
+	s.txnRouted = true
+	s.mailArg = msg.MailArg
+	var accepted []int
+	for _, i := range idx {
+		code, text, err := s.Passthru(25, "RCPT", msg.RcptArgs[i])
+		resps[i] = Response{Code: code, Msg: text}
+		if err == nil {
+			accepted = append(accepted, i)
+			s.rcptArgs = append(s.rcptArgs, msg.RcptArgs[i])
+			resps[i] = Response{} // known once the message is sent
+		} else if code == 599 {
+			return // the connection has failed, so retry the rest later
+		}
+	}
+	if len(accepted) == 0 {
+		s.Passthru(250, "RSET", "")
+		return
+	}
+	w, code, text, err := s.DataCommand()
+	if err != nil {
+		fail(code, text)
+		return
+	}
+	code, text, err = s.Data(body, w)
+	if code == 0 {
+		code, text = 451, "4.4.2 "+text
+	}
+	fail(code, text)
+	if lmtpResps := s.LMTPResponses(); len(lmtpResps) == len(accepted) {
+		for j, i := range accepted {
+			resps[i] = lmtpResps[j]
+		}
+	}
+}
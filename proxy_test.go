@@ -3,19 +3,27 @@ package smtpproxy_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"net/http/httptest"
 	"net/mail"
 	"net/smtp"
 	"net/textproto"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -97,12 +105,39 @@ type mockBackend struct {
 
 // A Session is returned after successful login. Here hold information that needs to persist across message phases.
 type mockSession struct {
-	MockState int
-	bkd       *mockBackend
+	MockState  int
+	bkd        *mockBackend
+	chunks     bytes.Buffer // message received so far via BDAT
+	rejectData bool         // a recipient asked for DATA to be rejected
 }
 
 // mockSMTPServer should be invoked as a goroutine to allow tests to continue
 func mockSMTPServer(t *testing.T, addr string, mockReply chan []byte) {
+	s := newMockServer(t, addr, mockReply)
+	if s == nil {
+		return
+	}
+
+	// Begin serving requests
+	t.Log("Upstream mock SMTP server listening on", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		t.Error(err)
+	}
+}
+
+// mockSMTPSServer is like mockSMTPServer, but with implicit TLS
+func mockSMTPSServer(t *testing.T, addr string, mockReply chan []byte) {
+	s := newMockServer(t, addr, mockReply)
+	if s == nil {
+		return
+	}
+	t.Log("Upstream mock SMTPS server listening on", s.Addr)
+	if err := s.ListenAndServeTLS(); err != nil {
+		t.Error(err)
+	}
+}
+
+func newMockServer(t *testing.T, addr string, mockReply chan []byte) *smtpproxy.Server {
 	mockbe := mockBackend{
 		mockReply: mockReply,
 	}
@@ -111,14 +146,10 @@ func mockSMTPServer(t *testing.T, addr string, mockReply chan []byte) {
 	s.ReadTimeout = 60 * time.Second // changeme?
 	s.WriteTimeout = 60 * time.Second
 	if err := s.ServeTLS(localhostCert, localhostKey); err != nil {
-		t.Fatal(err)
-	}
-
-	// Begin serving requests
-	t.Log("Upstream mock SMTP server listening on", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
-		t.Fatal(err)
+		t.Error(err)
+		return nil
 	}
+	return s
 }
 
 // Init the backend. This does not need to do much.
@@ -132,7 +163,7 @@ func (bkd *mockBackend) Init() (smtpproxy.Session, error) {
 // Greet the upstream host and report capabilities back.
 func (s *mockSession) Greet(helotype string) ([]string, int, string, error) {
 	s.MockState = Greeted
-	caps := []string{"8BITMIME", "STARTTLS", "ENHANCEDSTATUSCODES", "AUTH LOGIN PLAIN", "SMTPUTF8"}
+	caps := []string{"8BITMIME", "STARTTLS", "ENHANCEDSTATUSCODES", "AUTH LOGIN PLAIN", "SMTPUTF8", "PIPELINING", "CHUNKING", "BINARYMIME"}
 	return caps, 220, "", nil
 }
 
@@ -173,11 +204,15 @@ func (s *mockSession) Auth(expectcode int, cmd, arg string) (int, string, error)
 
 //Mail command mock backend handler
 func (s *mockSession) Mail(expectcode int, cmd, arg string) (int, string, error) {
+	s.rejectData = false
 	return 250, mockMsg, nil
 }
 
 //Rcpt command mock backend handler
 func (s *mockSession) Rcpt(expectcode int, cmd, arg string) (int, string, error) {
+	if strings.Contains(arg, "reject-data@") {
+		s.rejectData = true
+	}
 	return 250, mockMsg, nil
 }
 
@@ -209,6 +244,10 @@ func (myWriteCloser) Close() error {
 // DataCommand pass upstream, returning a place to write the data AND the usual responses
 // If you want to see the mail contents, replace Discard with os.Stdout
 func (s *mockSession) DataCommand() (io.WriteCloser, int, string, error) {
+	if s.rejectData {
+		msg := "5.7.1 mock rejects the message"
+		return nil, 554, msg, errors.New(msg)
+	}
 	return myWriteCloser{Writer: ioutil.Discard}, 354, `3.0.0 mock says continue.  finished with "\r\n.\r\n"`, nil
 }
 
@@ -225,13 +264,28 @@ func (s *mockSession) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
 	return 250, "2.0.0 OK mock got your dot", err
 }
 
+// Bdat collects the message chunks, emitting the whole message in the test harness response channel, if present
+func (s *mockSession) Bdat(size int64, last bool, r io.Reader) (int, string, error) {
+	if _, err := io.Copy(&s.chunks, r); err != nil {
+		return 451, "4.3.0 mock could not read chunk", err
+	}
+	if !last {
+		return 250, fmt.Sprintf("2.0.0 mock got %d octets", size), nil
+	}
+	if s.bkd.mockReply != nil {
+		s.bkd.mockReply <- s.chunks.Bytes()
+	}
+	s.chunks = bytes.Buffer{}
+	return 250, "2.0.0 OK mock got your chunks", nil
+}
+
 //-----------------------------------------------------------------------------
 // Start proxy server
 
 func startProxy(t *testing.T, s *smtpproxy.Server) {
 	t.Log("Proxy (unit under test) listening on", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
-		t.Fatal(err)
+	if err := s.ListenAndServe(); err != nil && err != smtpproxy.ErrServerClosed {
+		t.Error(err)
 	}
 }
 
@@ -253,6 +307,50 @@ const inHostPort = "localhost:5580" // need to specifically have keyword localho
 const outHostPort = ":5581"
 const downstreamDebug = "debug_proxy_test.log"
 const inHostPort2 = "localhost:5582" // need to specifically have keyword localhost in here for c.Auth to accept nonsecure connections
+const inHostPort3 = "localhost:5583"
+const outHostPort3 = ":5584"
+const inHostPortTLS = "localhost:5585"
+const outHostPortTLS = "localhost:5586"
+const inHostPort4 = "localhost:5587"
+const outHostPort4 = ":5588"
+const inHostPortAuth = "localhost:5589"
+const outHostPortAuth = ":5590"
+const inHostPortNoAuth = "localhost:5591"
+const inHostPortLocalAuth = "localhost:5592"
+const outHostPortLocalAuth = ":5593"
+const inHostPortPipeline = "localhost:5594"
+const outHostPortPipeline = ":5595"
+const inHostPortBdat = "localhost:5596"
+const outHostPortBdat = ":5597"
+const inHostPortLMTP = "localhost:5598"
+const inHostPortBlackhole = "localhost:5599"
+const inHostPortRouted = "localhost:5600"
+const outHostPortRouted = ":5601"
+const inHostPortFailover = "localhost:5602"
+const outHostPortFailover = "localhost:5603"
+const inHostPortMX = "localhost:5604"
+const outPortMX = "5605"
+const inHostPortPool = "localhost:5606"
+const inHostPortQueue = "localhost:5607"
+const outHostPortQueue = ":5608"
+const inHostPortArchive = "localhost:5609"
+const outHostPortArchive = ":5610"
+const inHostPortFilter = "localhost:5611"
+const outHostPortFilter = ":5612"
+const inHostPortDKIM = "localhost:5613"
+const outHostPortDKIM = ":5614"
+const inHostPortMetrics = "localhost:5615"
+const outHostPortMetrics = ":5616"
+const inHostPortTxnLog = "localhost:5617"
+const outHostPortTxnLog = ":5618"
+const inHostPortTrace = "localhost:5619"
+const outHostPortTrace = ":5620"
+const inHostPortTranscript = "localhost:5621"
+const outHostPortTranscript = ":5622"
+const inHostPortLoop = "localhost:5623"
+const outHostPortLoop = ":5624"
+const inHostPortPoolAuth = "localhost:5625"
+const inHostPortSlowMail = "localhost:5626"
 
 func TestProxy(t *testing.T) {
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -298,6 +396,1635 @@ func TestProxy(t *testing.T) {
 	sendAndCheckEmails(t, inHostPort, 20, "STARTTLS", mockReply, RandomTestEmail)
 }
 
+func TestShutdown(t *testing.T) {
+	s, _, err := smtpproxy.CreateProxy(inHostPort3, outHostPort3, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPort3, mockReply)
+	go startProxy(t, s)
+
+	// One client part-way through a transaction, another idle
+	busy := dialProxy(t, inHostPort3)
+	if err := busy.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := busy.Mail(RandomRecipient()); err != nil {
+		t.Fatal(err)
+	}
+	if err := busy.Rcpt(RandomRecipient()); err != nil {
+		t.Fatal(err)
+	}
+	idle := dialProxy(t, inHostPort3)
+	if err := idle.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+
+	// The idle client is told to go away, without having to send anything
+	if code, msg, err := idle.Text.ReadResponse(421); err != nil {
+		t.Errorf("Idle client got %d %s, %v", code, msg, err)
+	}
+	// New connections are refused
+	if _, err := net.DialTimeout("tcp", inHostPort3, time.Second); err == nil {
+		t.Error("Expected new connection to be refused during shutdown")
+	}
+
+	// The busy client can still finish its message
+	w, err := busy.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, PlainEmail()); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	<-mockReply
+	if code, msg, err := busy.Text.ReadResponse(421); err != nil {
+		t.Errorf("Busy client got %d %s, %v", code, msg, err)
+	}
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// slowMailServer is an upstream server that holds its response to MAIL until release is closed
+func slowMailServer(t *testing.T, release chan struct{}) net.Listener {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 slow ESMTP")
+				for inData := false; ; {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+					switch {
+					case inData:
+						if line == "." {
+							inData = false
+							tp.PrintfLine("250 2.0.0 OK")
+						}
+					case cmd == "EHLO":
+						tp.PrintfLine("250 slow")
+					case cmd == "MAIL":
+						<-release
+						tp.PrintfLine("250 2.1.0 OK")
+					case cmd == "DATA":
+						inData = true
+						tp.PrintfLine("354 Go ahead")
+					case cmd == "QUIT":
+						tp.PrintfLine("221 2.0.0 Bye")
+						return
+					default:
+						tp.PrintfLine("250 2.0.0 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestShutdownDuringMail(t *testing.T) {
+	release := make(chan struct{})
+	ln := slowMailServer(t, release)
+	defer ln.Close()
+	s := smtpproxy.NewServer(smtpproxy.NewBackend(ln.Addr().String(), false, true))
+	s.Addr = inHostPortSlowMail
+	s.Domain = "localhost"
+	go startProxy(t, s)
+
+	// Shutdown polls while MAIL is upstream, with no ReadTimeout to refresh the read deadline afterwards
+	c := dialProxy(t, inHostPortSlowMail)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	mailed := make(chan error, 1)
+	go func() {
+		mailed <- c.Mail(RandomRecipient())
+	}()
+	time.Sleep(100 * time.Millisecond) // let MAIL reach the upstream
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond) // let Shutdown poll a few times
+	close(release)
+	if err := <-mailed; err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction still completes
+	if err := c.Rcpt(RandomRecipient()); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, PlainEmail()); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if code, msg, err := c.Text.ReadResponse(421); err != nil {
+		t.Errorf("Client got %d %s, %v", code, msg, err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	cfg, err := tlsClientConfig(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SMTPS client <--> proxy <--> SMTPS server
+	go mockSMTPSServer(t, outHostPortTLS, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortTLS, outHostPortTLS, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetUpstreamTLS(smtpproxy.UpstreamImplicitTLS)
+	go func() {
+		if err := s.ListenAndServeTLS(); err != nil && err != smtpproxy.ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	conn, err := tls.Dial("tcp", inHostPortTLS, cfg)
+	for i := 0; err != nil && i < 10; i++ {
+		time.Sleep(time.Millisecond * 100)
+		conn, err = tls.Dial("tcp", inHostPortTLS, cfg)
+	}
+	if err != nil {
+		t.Fatalf("Can't connect to proxy: %v\n", err)
+	}
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendOneEmail(t, c, "", mockReply)
+
+	// plain client, upgrading with STARTTLS <--> proxy <--> server that we always STARTTLS with
+	go mockSMTPServer(t, outHostPort4, mockReply)
+	s2, be2, err := smtpproxy.CreateProxy(inHostPort4, outHostPort4, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be2.SetUpstreamTLS(smtpproxy.UpstreamStartTLS)
+	go startProxy(t, s2)
+	sendOneEmail(t, dialProxy(t, inHostPort4), "STARTTLS", mockReply)
+
+	// plain client staying plain, still gets upstream STARTTLS
+	sendOneEmail(t, dialProxy(t, inHostPort4), "", mockReply)
+	s.Close()
+	s2.Close()
+}
+
+func TestAuthPolicy(t *testing.T) {
+	go mockSMTPServer(t, outHostPortAuth, nil)
+	s, _, err := smtpproxy.CreateProxy(inHostPortAuth, outHostPortAuth, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AllowInsecureAuth = false
+	s.AuthMechanisms = []string{"login", "XOAUTH2"}
+	go startProxy(t, s)
+	defer s.Close()
+
+	// Before TLS, AUTH is neither offered nor accepted
+	c := dialProxy(t, inHostPortAuth)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH offered before STARTTLS")
+	}
+	expectResponse(t, c, 530, "AUTH LOGIN")
+
+	// After TLS, only the permitted mechanisms that the upstream supports are offered
+	cfg, err := tlsClientConfig(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if ok, param := c.Extension("AUTH"); !ok || param != "LOGIN" {
+		t.Errorf("Got AUTH %v %s, expected LOGIN", ok, param)
+	}
+	expectResponse(t, c, 504, "AUTH PLAIN AHVzZXIAcGFzcw==")
+	expectResponse(t, c, 334, "AUTH LOGIN")
+	c.Close()
+
+	s2, _, err := smtpproxy.CreateProxy(inHostPortNoAuth, outHostPortAuth, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.AuthDisabled = true
+	go startProxy(t, s2)
+	defer s2.Close()
+	c = dialProxy(t, inHostPortNoAuth)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH offered when disabled")
+	}
+	expectResponse(t, c, 500, "AUTH PLAIN AHVzZXIAcGFzcw==")
+	c.Close()
+}
+
+func TestLocalAuth(t *testing.T) {
+	go mockSMTPServer(t, outHostPortLocalAuth, nil)
+	s, be, err := smtpproxy.CreateProxy(inHostPortLocalAuth, outHostPortLocalAuth, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := smtpproxy.AuthenticatorFunc(func(username, password string) error {
+		if username == "app" && password == "apppass" {
+			return nil
+		}
+		return smtpproxy.ErrAuthFailed
+	})
+	be.SetLocalAuth(users, smtpproxy.StaticCredentials("upstream-user", "upstream-api-key"))
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortLocalAuth)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, param := c.Extension("AUTH"); !ok || param != "PLAIN LOGIN" {
+		t.Errorf("Got AUTH %v %s, expected PLAIN LOGIN", ok, param)
+	}
+	expectResponse(t, c, 530, "MAIL FROM:<app@example.com>")
+	// LOGIN, driven by hand
+	expectResponse(t, c, 334, "AUTH LOGIN")
+	expectResponse(t, c, 334, base64.StdEncoding.EncodeToString([]byte("app")))
+	expectResponse(t, c, 235, base64.StdEncoding.EncodeToString([]byte("apppass")))
+	expectResponse(t, c, 503, "AUTH PLAIN")
+	expectResponse(t, c, 250, "MAIL FROM:<app@example.com>")
+	c.Quit()
+
+	c = dialProxy(t, inHostPortLocalAuth)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "app", "apppass", "localhost")); err != nil {
+		t.Error(err)
+	}
+	c.Quit()
+
+	c = dialProxy(t, inHostPortLocalAuth)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "app", "wrong", "localhost")); err == nil {
+		t.Error("Expected wrong password to fail")
+	}
+	c.Quit()
+
+	// The authorization identity must be absent or the same as the authentication identity
+	c = dialProxy(t, inHostPortLocalAuth)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, c, 535, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("admin\x00app\x00apppass")))
+	expectResponse(t, c, 530, "MAIL FROM:<admin@example.com>")
+	if err := c.Auth(smtp.PlainAuth("app", "app", "apppass", "localhost")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortPipeline, mockReply)
+	s, _, err := smtpproxy.CreateProxy(inHostPortPipeline, outHostPortPipeline, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortPipeline)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		t.Error("PIPELINING not offered")
+	}
+
+	// Send the whole envelope in one go, then collect the responses
+	cmds := []string{"MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "RCPT TO:<c@example.com>", "DATA"}
+	if _, err := c.Text.W.WriteString(strings.Join(cmds, "\r\n") + "\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, expectCode := range []int{250, 250, 250, 354} {
+		if code, msg, err := c.Text.ReadResponse(expectCode); err != nil {
+			t.Errorf("%s: got %d %s, expected %d", cmds[i], code, msg, expectCode)
+		}
+	}
+	testEmail := PlainEmail()
+	w := c.Text.DotWriter()
+	io.WriteString(w, testEmail)
+	w.Close()
+	if code, msg, err := c.Text.ReadResponse(250); err != nil {
+		t.Errorf("DATA: got %d %s", code, msg)
+	}
+	if got := <-mockReply; string(got) != testEmail {
+		t.Errorf("Got message %q, expected %q", got, testEmail)
+	}
+	c.Quit()
+}
+
+func TestBdat(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortBdat, mockReply)
+	s, _, err := smtpproxy.CreateProxy(inHostPortBdat, outHostPortBdat, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortBdat)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{"CHUNKING", "BINARYMIME"} {
+		if ok, _ := c.Extension(ext); !ok {
+			t.Errorf("%s not offered", ext)
+		}
+	}
+	expectResponse(t, c, 250, "MAIL FROM:<a@example.com> BODY=BINARYMIME")
+	expectResponse(t, c, 250, "RCPT TO:<b@example.com>")
+
+	// Chunks can contain anything, including what looks like the end of DATA
+	testEmail := strings.Replace(PlainEmail(), "\n", "\r\n", -1) + ".\r\n\x00binary\xff"
+	split := len(testEmail) / 2
+	sendChunk(t, c, 250, fmt.Sprintf("BDAT %d\r\n%s", split, testEmail[:split]))
+	sendChunk(t, c, 250, fmt.Sprintf("BDAT %d LAST\r\n%s", len(testEmail)-split, testEmail[split:]))
+	if got := <-mockReply; string(got) != testEmail {
+		t.Errorf("Got message %q, expected %q", got, testEmail)
+	}
+	sendChunk(t, c, 501, "BDAT 3 NOTLAST\r\nabc")
+	c.Quit()
+}
+
+// sendChunk sends a BDAT command and its data, which has no line ending of its own, and checks the response code
+func sendChunk(t *testing.T, c *smtp.Client, expectCode int, cmdAndData string) {
+	if _, err := c.Text.W.WriteString(cmdAndData); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if code, msg, err := c.Text.ReadResponse(expectCode); err != nil {
+		t.Errorf("BDAT: got %d %s, expected %d", code, msg, expectCode)
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstreamSocket := dir + "/upstream.sock"
+	proxySocket := dir + "/proxy.sock"
+
+	mockReply := make(chan []byte, 1)
+	mock := newMockServer(t, upstreamSocket, mockReply)
+	mock.LMTP = true
+	go func() {
+		if err := mock.ListenAndServe(); err != nil && err != smtpproxy.ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	defer mock.Close()
+
+	// SMTP client <--> proxy <--> LMTP server. Recipient responses are summarised
+	s, be, err := smtpproxy.CreateProxy(inHostPortLMTP, upstreamSocket, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetUpstreamLMTP(true)
+	go startProxy(t, s)
+	defer s.Close()
+	c := dialProxy(t, inHostPortLMTP)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(RandomRecipient()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Rcpt(RandomRecipient()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, PlainEmail())
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	<-mockReply
+	c.Quit()
+
+	// LMTP client <--> proxy <--> LMTP server. Each recipient gets a response
+	s2, be2, err := smtpproxy.CreateProxy(proxySocket, upstreamSocket, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.LMTP = true
+	be2.SetUpstreamLMTP(true)
+	go startProxy(t, s2)
+	defer s2.Close()
+	var conn net.Conn
+	for i := 0; i < 10; i++ {
+		if conn, err = net.Dial("unix", proxySocket); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := textproto.NewConn(conn)
+	defer lc.Close()
+	if _, _, err := lc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"LHLO localhost", "MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "RCPT TO:<c@example.com>"} {
+		lc.PrintfLine("%s", cmd)
+		if code, msg, err := lc.ReadResponse(250); err != nil {
+			t.Errorf("%s: got %d %s", cmd, code, msg)
+		}
+	}
+	lc.PrintfLine("DATA")
+	if code, msg, err := lc.ReadResponse(354); err != nil {
+		t.Fatalf("DATA: got %d %s", code, msg)
+	}
+	dw := lc.DotWriter()
+	io.WriteString(dw, PlainEmail())
+	dw.Close()
+	<-mockReply
+	for i := 0; i < 2; i++ {
+		if code, msg, err := lc.ReadResponse(250); err != nil {
+			t.Errorf("DATA recipient %d: got %d %s", i, code, msg)
+		}
+	}
+	lc.PrintfLine("EHLO localhost")
+	if code, msg, err := lc.ReadResponse(500); err != nil {
+		t.Errorf("EHLO to LMTP server: got %d %s", code, msg)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortRouted, mockReply)
+
+	// The fixed upstream is unused: this client is routed by subnet
+	s, be, err := smtpproxy.CreateProxy(inHostPortRouted, "localhost:1", false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, ipv6Loopback, _ := net.ParseCIDR("::1/128")
+	be.SetRouter(smtpproxy.SubnetRouter([]smtpproxy.SubnetRoute{
+		{Net: loopback, HostPort: outHostPortRouted},
+		{Net: ipv6Loopback, HostPort: outHostPortRouted},
+	}, ""))
+	go startProxy(t, s)
+	defer s.Close()
+	sendOneEmail(t, dialProxy(t, inHostPortRouted), "", mockReply)
+
+	// The router sees the client's HELO name, and can reject it
+	var gotState smtpproxy.ConnectionState
+	be.SetRouter(func(state smtpproxy.ConnectionState) (string, error) {
+		gotState = state
+		return "", smtpproxy.ErrClientRejected
+	})
+	c := dialProxy(t, inHostPortRouted)
+	expectResponse(t, c, 554, "EHLO client.example")
+	if gotState.Hostname != "client.example" || gotState.RemoteAddr == nil {
+		t.Errorf("Router got unexpected connection state %+v", gotState)
+	}
+}
+
+// refusingServer greets, then refuses every command
+func refusingServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := textproto.NewConn(conn)
+				tc.PrintfLine("220 refusing.example ESMTP")
+				for {
+					if _, err := tc.ReadLine(); err != nil {
+						return
+					}
+					tc.PrintfLine("554 5.7.1 Go away")
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestFailover(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortFailover, mockReply)
+	refusing := refusingServer(t)
+	defer refusing.Close()
+	dead, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close() // nothing listening here now
+
+	pool := smtpproxy.NewUpstreamPool([]smtpproxy.Upstream{
+		{HostPort: deadAddr, Priority: 1},
+		{HostPort: refusing.Addr().String(), Priority: 2},
+		{HostPort: outHostPortFailover, Priority: 3},
+	})
+	s, be, err := smtpproxy.CreateProxy(inHostPortFailover, deadAddr, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetUpstreams(pool)
+	go startProxy(t, s)
+	defer s.Close()
+	sendOneEmail(t, dialProxy(t, inHostPortFailover), "", mockReply)
+	if pool.Healthy(deadAddr) || pool.Healthy(refusing.Addr().String()) || !pool.Healthy(outHostPortFailover) {
+		t.Error("Expected failed upstreams to be marked down")
+	}
+
+	// The session records the upstream it's using
+	session, err := be.InitContext(context.Background(), smtpproxy.ConnectionState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Quit(221, "QUIT", "")
+	if u, ok := session.(interface{ Upstream() string }); !ok || u.Upstream() != outHostPortFailover {
+		t.Errorf("Expected session upstream %s", outHostPortFailover)
+	}
+}
+
+func TestMXRouting(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, ":"+outPortMX, mockReply)
+
+	// Two domains with different mail exchangers, both of which are the mock server. Its certificate isn't
+	// trusted, but STARTTLS to an MX host is opportunistic.
+	s, be, err := smtpproxy.CreateProxy(inHostPortMX, "", false, localhostCert, localhostKey, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetRecipientRouter(smtpproxy.MXRouter(&fakeResolver{
+		mx: map[string][]*net.MX{
+			"a.example": {{Host: "localhost.", Pref: 10}},
+			"b.example": {{Host: "127.0.0.1.", Pref: 10}},
+		},
+	}, outPortMX))
+	be.SetHelloName("relay.example.org")
+	transcripts := make(chan string, 1)
+	s.Transcripts = &smtpproxy.TranscriptRecorder{
+		Sink: smtpproxy.TranscriptSinkFunc(func(sessionID string, transcript []byte) error {
+			transcripts <- string(transcript)
+			return nil
+		}),
+	}
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortMX)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	// No upstream is needed until the first recipient
+	expectResponse(t, c, 503, "RCPT TO:<early@a.example>")
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectResponse(t, c, 250, "RCPT TO:<one@a.example>")
+	expectResponse(t, c, 250, "RCPT TO:<two@a.example>")
+	expectResponse(t, c, 452, "RCPT TO:<three@b.example>")
+	expectResponse(t, c, 550, "RCPT TO:<four@nonexistent.example>")
+	sendData(t, c, mockReply)
+
+	// The deferred recipient can then be sent separately, via a new upstream connection
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectResponse(t, c, 250, "RCPT TO:<three@b.example>")
+	sendData(t, c, mockReply)
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+	// The MX hosts are greeted with the proxy's name, not their own, and the connections secured
+	got := <-transcripts
+	for e, n := range map[string]int{"P->U EHLO relay.example.org\n": 4, "P->U STARTTLS\n": 2, "U->P 220 \n": 2} {
+		if strings.Count(got, e) != n {
+			t.Errorf("Expected %q %d times in transcript:\n%s", e, n, got)
+		}
+	}
+	if strings.Contains(got, "P->U EHLO localhost") || strings.Contains(got, "P->U EHLO 127.0.0.1") {
+		t.Errorf("MX host greeted with its own name in transcript:\n%s", got)
+	}
+}
+
+// sendData sends a message body through an established client connection, checking it arrives upstream
+func sendData(t *testing.T, c *smtp.Client, mockReply chan []byte) {
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, PlainEmail()); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if got := <-mockReply; !bytes.Contains(got, []byte("Subject:")) {
+		t.Errorf("Unexpected message upstream %q", got)
+	}
+}
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestClientPool(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &countingListener{Listener: ln}
+	mock := newMockServer(t, "", mockReply)
+	go mock.Serve(upstream)
+	defer mock.Close()
+
+	s, be, err := smtpproxy.CreateProxy(inHostPortPool, ln.Addr().String(), false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetUpstreamTLS(smtpproxy.UpstreamStartTLS)
+	be.SetLocalAuth(smtpproxy.AuthenticatorFunc(func(username, password string) error {
+		return nil
+	}), smtpproxy.StaticCredentials("upstreamuser", "upstreampass"))
+	pool := &smtpproxy.ClientPool{MaxMessages: 2} // a literal pool works as well as NewClientPool's
+	defer pool.Close()
+	be.SetClientPool(pool)
+	go startProxy(t, s)
+	defer s.Close()
+
+	// The second session reuses the first's secured, authenticated connection. It's then retired, having
+	// carried its quota of messages, so the third session needs another.
+	for i, expected := range []int32{1, 1, 2} {
+		sendOneEmail(t, dialProxy(t, inHostPortPool), "", mockReply)
+		if got := atomic.LoadInt32(&upstream.accepted); got != expected {
+			t.Errorf("After session %d, got %d upstream connections, expected %d", i+1, got, expected)
+		}
+	}
+
+	// Idle connections that have timed out are not reused
+	pool.IdleTimeout = time.Nanosecond
+	sendOneEmail(t, dialProxy(t, inHostPortPool), "", mockReply)
+	if got := atomic.LoadInt32(&upstream.accepted); got != 3 {
+		t.Errorf("Got %d upstream connections, expected 3", got)
+	}
+}
+
+func TestClientPoolAuthSwitch(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &countingListener{Listener: ln}
+	mock := newMockServer(t, "", mockReply)
+	go mock.Serve(upstream)
+	defer mock.Close()
+
+	s, be, err := smtpproxy.CreateProxy(inHostPortPoolAuth, ln.Addr().String(), false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetUpstreamTLS(smtpproxy.UpstreamStartTLS)
+	be.SetLocalAuth(smtpproxy.AuthenticatorFunc(func(username, password string) error {
+		return nil
+	}), func(username string) (*smtpproxy.Credentials, error) {
+		return &smtpproxy.Credentials{Username: "upstream-" + username, Password: "secret"}, nil
+	})
+	pool := smtpproxy.NewClientPool()
+	defer pool.Close()
+	be.SetClientPool(pool)
+	transcripts := make(chan string, 2)
+	s.Transcripts = &smtpproxy.TranscriptRecorder{
+		Sink: smtpproxy.TranscriptSinkFunc(func(sessionID string, transcript []byte) error {
+			transcripts <- string(transcript)
+			return nil
+		}),
+	}
+	go startProxy(t, s)
+	defer s.Close()
+
+	// The second user is given the first's pooled connection, authenticated for someone else, so needs a
+	// fresh one. It's secured before the credentials are sent.
+	var got string
+	for _, user := range []string{"alice", "bob"} {
+		c := dialProxy(t, inHostPortPoolAuth)
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Auth(smtp.PlainAuth("", user, "password", "localhost")); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Quit(); err != nil {
+			t.Error(err)
+		}
+		got = <-transcripts
+	}
+	if n := atomic.LoadInt32(&upstream.accepted); n != 2 {
+		t.Errorf("Got %d upstream connections, expected 2", n)
+	}
+	i := strings.Index(got, "--- Connected upstream")
+	if i < 0 || !strings.Contains(got, "--- Reusing upstream connection") {
+		t.Fatalf("Expected a pooled connection to be replaced in transcript:\n%s", got)
+	}
+	fresh := got[i:]
+	tls, auth := strings.Index(fresh, "U->P 220 \n"), strings.Index(fresh, "P->U AUTH PLAIN")
+	if tls < 0 || auth < 0 || tls > auth || !strings.Contains(fresh[:tls], "P->U STARTTLS\n") {
+		t.Errorf("Expected STARTTLS before AUTH upstream in transcript:\n%s", got)
+	}
+
+	// Credentials aren't sent to a remote server without TLS, unless allowed
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := smtpproxy.NewClient(conn, "mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, _, err := client.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, err := client.Auth("user", "password"); err == nil || code != 530 {
+		t.Errorf("Got %d %v, expected AUTH without TLS to be refused", code, err)
+	}
+	client.AllowInsecureAuth = true
+	if code, msg, err := client.Auth("user", "password"); err != nil {
+		t.Errorf("Got %d %s %v, expected AUTH to be allowed", code, msg, err)
+	}
+}
+
+func TestQueueMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := smtpproxy.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MinRetry = 50 * time.Millisecond
+	s, be, err := smtpproxy.CreateProxy(inHostPortQueue, outHostPortQueue, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetQueue(q)
+	go startProxy(t, s)
+	defer s.Close()
+
+	// The message is accepted while the upstream is down
+	c := dialProxy(t, inHostPortQueue)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, c, 503, "DATA")
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectResponse(t, c, 250, "RCPT TO:<one@example.com>")
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, PlainEmail()); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Got %d queued messages, expected 1", q.Len())
+	}
+
+	// and delivered once the upstream is back
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx, be.Deliver)
+	time.Sleep(100 * time.Millisecond)
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortQueue, mockReply)
+	select {
+	case got := <-mockReply:
+		if !bytes.Contains(got, []byte("Subject:")) {
+			t.Errorf("Unexpected message upstream %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued message not delivered")
+	}
+	for start := time.Now(); q.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Delivered message not removed from queue")
+		}
+	}
+}
+
+func TestArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archiver, err := smtpproxy.NewMaildirArchiver(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortArchive, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortArchive, outHostPortArchive, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetArchiver(archiver)
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortArchive)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	// The recipients of a transaction whose DATA was refused don't carry over to the next
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectResponse(t, c, 250, "RCPT TO:<reject-data@example.com>")
+	expectResponse(t, c, 554, "DATA")
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectResponse(t, c, 250, "RCPT TO:<one@example.com>")
+	sendData(t, c, mockReply)
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one archived message, got %v %v", files, err)
+	}
+	got, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Return-Path: <sender@example.org>\n", "X-Envelope-To: <one@example.com>\n",
+		"X-Proxy-Client: 127.0.0.1:", "X-Proxy-Response: 250 2.0.0 OK mock got your dot\n", "Subject:"} {
+		if !bytes.Contains(got, []byte(s)) {
+			t.Errorf("Expected %q in archived message %q", s, got)
+		}
+	}
+	if bytes.Contains(got, []byte("\r")) {
+		t.Errorf("Expected LF line endings in archived message %q", got)
+	}
+	if bytes.Contains(got, []byte("reject-data@")) {
+		t.Errorf("Recipient of an earlier transaction in archived message %q", got)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortFilter, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortFilter, outHostPortFilter, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetFilters(
+		smtpproxy.MessageFilterFunc(func(env *smtpproxy.Envelope, h *smtpproxy.Header, body io.Reader) (io.Reader, error) {
+			if strings.Contains(h.Get("Subject"), "reject me") {
+				return nil, &smtpproxy.SMTPError{Code: 554, EnhancedCode: smtpproxy.EnhancedCode{5, 7, 0}, Message: "Not today"}
+			}
+			h.Add("X-Filtered-For", strings.Join(env.RcptTo, ","))
+			return body, nil
+		}),
+	)
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortFilter)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	// A rejected message resets the upstream transaction, so the next can be sent
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectResponse(t, c, 250, "RCPT TO:<one@example.com>")
+	expectResponse(t, c, 354, "DATA")
+	expectResponse(t, c, 554, "Subject: reject me\r\n\r\nbody\r\n.")
+	for _, chunked := range []bool{false, true} {
+		expectResponse(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectResponse(t, c, 250, "RCPT TO:<one@example.com>")
+		if chunked {
+			sendChunk(t, c, 250, "BDAT 6\r\nSubjec")
+			sendChunk(t, c, 250, "BDAT 20 LAST\r\nt: chunked\r\n\r\nbody\r\n")
+		} else {
+			expectResponse(t, c, 354, "DATA")
+			expectResponse(t, c, 250, "Subject: accept me\r\n\r\nbody\r\n.")
+		}
+		if got := string(<-mockReply); !strings.Contains(got, "X-Filtered-For: one@example.com") {
+			t.Errorf("Expected added header in %q", got)
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDKIMSigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := testDKIMKeys(t, dir)
+	signer, err := smtpproxy.LoadDKIMKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortDKIM, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortDKIM, outHostPortDKIM, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetDKIMSigner(signer)
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortDKIM)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunked := range []bool{false, true} {
+		expectResponse(t, c, 250, "MAIL FROM:<sender@example.com>")
+		expectResponse(t, c, 250, "RCPT TO:<one@example.org>")
+		if chunked {
+			sendChunk(t, c, 250, "BDAT 37 LAST\r\nFrom: sender@example.com\r\n\r\nchunked\r\n")
+		} else {
+			expectResponse(t, c, 354, "DATA")
+			expectResponse(t, c, 250, "From: sender@example.com\r\nSubject: signed\r\n\r\nbody\r\n.")
+		}
+		got := string(<-mockReply)
+		if selectors, err := verifyDKIM(got, keys); err != nil || len(selectors) != 2 {
+			t.Errorf("Got signatures from %v, %v in %q", selectors, err, got)
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortMetrics, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortMetrics, outHostPortMetrics, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := smtpproxy.NewMetrics()
+	s.Metrics = m
+	be.SetMetrics(m)
+	go startProxy(t, s)
+	defer s.Close()
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+
+	sendOneEmail(t, dialProxy(t, inHostPortMetrics), "STARTTLS", mockReply)
+	got := scrape()
+	for _, line := range []string{
+		"# TYPE smtpproxy_upstream_dial_seconds histogram",
+		"smtpproxy_downstream_connections_total 1",
+		"smtpproxy_upstream_dial_seconds_count 1",
+		`smtpproxy_upstream_dial_seconds_bucket{le="+Inf"} 1`,
+		"smtpproxy_upstream_dial_failures_total 0",
+		`smtpproxy_upstream_responses_total{command="MAIL",code="250"} 1`,
+		`smtpproxy_upstream_responses_total{command="DATA",code="354"} 1`,
+		`smtpproxy_upstream_responses_total{command="DATA",code="250"} 1`,
+		`smtpproxy_message_bytes_count{command="DATA"} 1`,
+		`smtpproxy_message_seconds_count{command="DATA"} 1`,
+		`smtpproxy_starttls_total{side="downstream",result="success"} 1`,
+		`smtpproxy_starttls_total{side="upstream",result="success"} 1`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, got)
+		}
+	}
+	// The client has quit, so its connection closes
+	for i := 0; i < 20 && !strings.Contains(got, "smtpproxy_downstream_connections 0\n"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		got = scrape()
+	}
+	if !strings.Contains(got, "smtpproxy_downstream_connections 0\n") {
+		t.Errorf("Expected no connections open in metrics:\n%s", got)
+	}
+
+	// Unknown commands are counted together, and upstreams that can't be reached as failures
+	c := dialProxy(t, inHostPortMetrics)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, c, 500, "XYZZ")
+	c.Close()
+
+	// A failed downstream handshake is counted, and the client is disconnected without anything more said
+	c = dialProxy(t, inHostPortMetrics)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, c, 220, "STARTTLS")
+	if err := c.Text.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(c.Text.R); err != nil || len(b) != 0 {
+		t.Errorf("Got %q, %v after a failed handshake, expected the connection to close", b, err)
+	}
+	c.Close()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	be2 := smtpproxy.NewBackend(ln.Addr().String(), false, true)
+	be2.SetMetrics(m)
+	if _, err := be2.InitContext(context.Background(), smtpproxy.ConnectionState{}); err == nil {
+		t.Error("Expected an error connecting to a closed port")
+	}
+
+	// An upstream certificate that isn't trusted fails STARTTLS
+	be3 := smtpproxy.NewBackend("localhost"+outHostPortMetrics, false, false)
+	be3.SetMetrics(m)
+	be3.SetUpstreamTLS(smtpproxy.UpstreamStartTLS)
+	sess, err := be3.InitContext(context.Background(), smtpproxy.ConnectionState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, msg, err := sess.Greet("EHLO"); err == nil || code != 599 {
+		t.Errorf("Got %d %s %v, expected STARTTLS to fail", code, msg, err)
+	}
+	sess.Quit(221, "QUIT", "")
+	got = scrape()
+	for _, line := range []string{
+		`smtpproxy_upstream_responses_total{command="OTHER",code="500"} 1`,
+		"smtpproxy_upstream_dial_failures_total 1",
+		`smtpproxy_starttls_total{side="upstream",result="failure"} 1`,
+		`smtpproxy_starttls_total{side="downstream",result="failure"} 1`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, got)
+		}
+	}
+}
+
+func TestTransactionLog(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortTxnLog, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortTxnLog, outHostPortTxnLog, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan *smtpproxy.TransactionEvent, 10)
+	be.SetTransactionLogger(smtpproxy.TransactionLoggerFunc(func(ev *smtpproxy.TransactionEvent) {
+		events <- ev
+	}))
+	go startProxy(t, s)
+	defer s.Close()
+
+	sendOneEmail(t, dialProxy(t, inHostPortTxnLog), "STARTTLS", mockReply)
+	ev := <-events
+	if ev.SessionID == "" || !strings.HasPrefix(ev.ClientAddr, "127.0.0.1:") || ev.Helo != "localhost" {
+		t.Errorf("Unexpected session in %+v", ev)
+	}
+	if !strings.HasPrefix(ev.ClientTLS, "TLS") || !strings.HasPrefix(ev.UpstreamTLS, "TLS") || ev.Upstream != outHostPortTxnLog {
+		t.Errorf("Unexpected TLS or upstream in %+v", ev)
+	}
+	if !strings.Contains(ev.MailFrom, "@") || len(ev.Recipients) != 1 || ev.Recipients[0].Code != 250 ||
+		ev.Recipients[0].Msg != mockMsg || !strings.Contains(ev.Recipients[0].Address, "@") {
+		t.Errorf("Unexpected envelope in %+v", ev)
+	}
+	if ev.Command != "DATA" || ev.Code != 250 || ev.Msg != "2.0.0 OK mock got your dot" || ev.Size == 0 || ev.QueueID != "" {
+		t.Errorf("Unexpected message result in %+v", ev)
+	}
+	if ev.Time.IsZero() || ev.LatencyMS < 0 {
+		t.Errorf("Unexpected timing in %+v", ev)
+	}
+
+	// A transaction abandoned with RSET is logged without a message
+	c := dialProxy(t, inHostPortTxnLog)
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	ev2 := <-events
+	if ev2.SessionID == ev.SessionID || ev2.Helo != "client.example.com" || ev2.ClientTLS != "" || ev2.MailFrom != "sender@example.com" ||
+		len(ev2.Recipients) != 1 || ev2.Recipients[0].Address != "a@example.com" || ev2.Command != "" || ev2.Code != 0 {
+		t.Errorf("Unexpected abandoned transaction %+v", ev2)
+	}
+	c.Quit()
+
+	// The queue ID is taken from the response, and events are written as JSON lines
+	dir, err := ioutil.TempDir("", "txnlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := smtpproxy.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	be2 := smtpproxy.NewBackend(outHostPortTxnLog, false, true)
+	be2.SetQueue(q)
+	be2.SetTransactionLogger(smtpproxy.NewJSONLogger(&out))
+	session, err := be2.InitContext(context.Background(), smtpproxy.ConnectionState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Mail(0, "MAIL", "FROM:<sender@example.com>")
+	session.Rcpt(0, "RCPT", "TO:<a@example.com>")
+	session.Rcpt(0, "RCPT", "TO:<b@example.com>")
+	if _, code, msg, err := session.DataCommand(); err != nil || code != 354 {
+		t.Fatal(code, msg, err)
+	}
+	code, msg, err := session.Data(strings.NewReader("Subject: test\n\nHello\n"), nil)
+	if err != nil || code != 250 {
+		t.Fatal(code, msg, err)
+	}
+	var logged smtpproxy.TransactionEvent
+	if err := json.Unmarshal(out.Bytes(), &logged); err != nil || !strings.HasSuffix(out.String(), "}\n") {
+		t.Fatalf("Unexpected log %q: %v", out.String(), err)
+	}
+	if logged.QueueID == "" || msg != "2.0.0 Queued as "+logged.QueueID || logged.Size != 21 || len(logged.Recipients) != 2 {
+		t.Errorf("Unexpected queued transaction %+v, response %s", logged, msg)
+	}
+	if !strings.Contains(out.String(), `"mail_from":"sender@example.com","recipients":[{"address":"a@example.com","code":250`) {
+		t.Errorf("Unexpected JSON %s", out.String())
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that's safe for concurrent use
+type lockedBuffer struct {
+	locker sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.buf.String()
+}
+
+func TestTraceHeaders(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortTrace, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortTrace, outHostPortTrace, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var debug lockedBuffer
+	s.Debug = &debug
+	be.SetTraceHeaders(&smtpproxy.TraceHeaders{Domain: "proxy.example.com", Received: true, TransactionID: true})
+	events := make(chan *smtpproxy.TransactionEvent, 10)
+	be.SetTransactionLogger(smtpproxy.TransactionLoggerFunc(func(ev *smtpproxy.TransactionEvent) {
+		events <- ev
+	}))
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortTrace)
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var sessionID string
+	txnIDs := map[string]bool{}
+	for _, chunked := range []bool{false, true} {
+		expectResponse(t, c, 250, "MAIL FROM:<sender@example.com>")
+		expectResponse(t, c, 250, "RCPT TO:<one@example.org>")
+		if chunked {
+			sendChunk(t, c, 250, "BDAT 14\r\nSubject: two\r\n")
+			sendChunk(t, c, 250, "BDAT 8 LAST\r\n\r\nbody\r\n")
+		} else {
+			expectResponse(t, c, 354, "DATA")
+			expectResponse(t, c, 250, "Subject: one\r\n\r\nbody\r\n.")
+		}
+		got := string(<-mockReply)
+		ev := <-events
+		sessionID = ev.SessionID
+		if ev.TransactionID == "" || txnIDs[ev.TransactionID] {
+			t.Errorf("Expected a new transaction ID in %+v", ev)
+		}
+		txnIDs[ev.TransactionID] = true
+		re := regexp.MustCompile(`^Received: from client\.example\.com \(\[127\.0\.0\.1\]\)\r?\n\tby proxy\.example\.com with ESMTP id ` +
+			ev.TransactionID + `;\r?\n\t[^\r\n]+ [+-]\d{4}\r?\nX-Proxy-Transaction-ID: ` + ev.TransactionID + `\r?\nSubject: `)
+		if !re.MatchString(got) {
+			t.Errorf("Unexpected trace headers in %q", got)
+		}
+		if chunked && !strings.HasSuffix(got, "Subject: two\r\n\r\nbody\r\n") {
+			t.Errorf("Unexpected chunked message %q", got)
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+	// Each line of the debug transcript is tagged with the session, once it ends
+	for i := 0; i < 20 && !strings.Contains(debug.String(), "closed\n"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines := strings.Split(strings.TrimSuffix(debug.String(), "\n"), "\n")
+	if len(lines) < 10 {
+		t.Fatalf("Expected a transcript, got %q", debug.String())
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, sessionID+" ") {
+			t.Errorf("Expected session %s in transcript line %q", sessionID, line)
+		}
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortLoop, mockReply)
+	s, be, err := smtpproxy.CreateProxy(inHostPortLoop, outHostPortLoop, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetTraceHeaders(&smtpproxy.TraceHeaders{Domain: "proxy.example.com", Received: true, MaxHops: 2})
+	go startProxy(t, s)
+	defer s.Close()
+
+	c := dialProxy(t, inHostPortLoop)
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := tlsClientConfig(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user@example.com", "password", "localhost")); err != nil {
+		t.Fatal(err)
+	}
+	// The Received header gives the TLS cipher, and the protocol shows TLS and AUTH were used
+	received := regexp.MustCompile(`^Received: from client\.example\.com \(\[127\.0\.0\.1\]\)\r?\n` +
+		`\t\(using TLS 1\.\d with cipher TLS_\w+\)\r?\n\tby proxy\.example\.com with ESMTPSA id \w+;\r?\n\t[^\r\n]+\r?\n` +
+		`Received: from one\.example\.com`)
+	hops := "Received: from one.example.com by two.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+		"Received: from zero.example.com\r\n\tby one.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n"
+	loop := hops + "Received: from two.example.com by one.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n"
+	body := "Subject: hi\r\n\r\nbody\r\n"
+	for _, chunked := range []bool{false, true} {
+		// Messages within the limit are passed on, with a hop added
+		expectResponse(t, c, 250, "MAIL FROM:<sender@example.com>")
+		expectResponse(t, c, 250, "RCPT TO:<one@example.org>")
+		if chunked {
+			sendChunk(t, c, 250, fmt.Sprintf("BDAT %d\r\n%s", len(hops), hops))
+			sendChunk(t, c, 250, fmt.Sprintf("BDAT %d LAST\r\n%s", len(body), body))
+		} else {
+			expectResponse(t, c, 354, "DATA")
+			expectResponse(t, c, 250, hops+body+".")
+		}
+		if got := string(<-mockReply); !received.MatchString(got) {
+			t.Errorf("Unexpected Received headers in %q", got)
+		}
+
+		// Messages over it are rejected, without reaching the upstream
+		expectResponse(t, c, 250, "MAIL FROM:<sender@example.com>")
+		expectResponse(t, c, 250, "RCPT TO:<one@example.org>")
+		if chunked {
+			sendChunk(t, c, 250, fmt.Sprintf("BDAT %d\r\n%s", len(hops), hops))
+			rest := loop[len(hops):] + body
+			sendChunk(t, c, 554, fmt.Sprintf("BDAT %d LAST\r\n%s", len(rest), rest))
+		} else {
+			expectResponse(t, c, 354, "DATA")
+			expectResponse(t, c, 554, loop+body+".")
+		}
+		select {
+		case got := <-mockReply:
+			t.Errorf("Looping message was sent upstream: %q", got)
+		default:
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranscripts(t *testing.T) {
+	mockReply := make(chan []byte, 1)
+	go mockSMTPServer(t, outHostPortTranscript, mockReply)
+	s, _, err := smtpproxy.CreateProxy(inHostPortTranscript, outHostPortTranscript, false, localhostCert, localhostKey, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcripts := make(chan string, 2)
+	s.Transcripts = &smtpproxy.TranscriptRecorder{
+		Sink: smtpproxy.TranscriptSinkFunc(func(sessionID string, transcript []byte) error {
+			transcripts <- string(transcript)
+			return nil
+		}),
+		MaxData: 20,
+	}
+	go startProxy(t, s)
+	defer s.Close()
+	lineRe := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S* (C->P|P->C|P->U|U->P|---) `)
+	checkTranscript := func(got string, expect []string, secrets ...string) {
+		for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+			if !lineRe.MatchString(line) {
+				t.Errorf("Unexpected transcript line %q", line)
+			}
+		}
+		for _, e := range expect {
+			if !strings.Contains(got, e) {
+				t.Errorf("Expected %q in transcript:\n%s", e, got)
+			}
+		}
+		for _, secret := range secrets {
+			if strings.Contains(got, secret) {
+				t.Errorf("Expected %q to be redacted from transcript:\n%s", secret, got)
+			}
+		}
+	}
+
+	// Both sides of the session are recorded, with AUTH PLAIN redacted and the message cut short
+	sendOneEmail(t, dialProxy(t, inHostPortTranscript), "STARTTLS", mockReply)
+	checkTranscript(<-transcripts, []string{
+		" --- Session ", " C->P EHLO localhost\n", " P->U EHLO ", " U->P 250-", " P->C 250-",
+		" C->P STARTTLS\n", " P->U STARTTLS\n", " --- Started TLS ",
+		" C->P AUTH PLAIN [redacted]\n", " P->U AUTH PLAIN [redacted]\n", " U->P 235 ",
+		" C->P DATA\n", " U->P 354 ", " bytes of message data not recorded]\n", " C->P .\n", " P->U .\n",
+		" U->P 250 2.0.0 OK mock got your dot\n", " C->P QUIT\n", " --- Session ",
+	}, base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+
+	// AUTH LOGIN responses are redacted, and BDAT chunks counted out
+	c := dialProxy(t, inHostPortTranscript)
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	user, password := base64.StdEncoding.EncodeToString([]byte("user")), base64.StdEncoding.EncodeToString([]byte("secret"))
+	expectResponse(t, c, 334, "AUTH LOGIN")
+	expectResponse(t, c, 334, user)
+	expectResponse(t, c, 235, password)
+	expectResponse(t, c, 250, "MAIL FROM:<sender@example.com>")
+	expectResponse(t, c, 250, "RCPT TO:<one@example.org>")
+	sendChunk(t, c, 250, "BDAT 14\r\nSubject: two\r\n")
+	sendChunk(t, c, 250, "BDAT 26 LAST\r\n\r\nbody more than the limit")
+	<-mockReply
+	expectResponse(t, c, 500, "NOOP")
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	checkTranscript(<-transcripts, []string{
+		" C->P AUTH LOGIN\n", " C->P [redacted]\n", " P->U [redacted]\n",
+		" C->P BDAT 14\n", " C->P Subject: two\n", " C->P BDAT 26 LAST\n",
+		" C->P [24 bytes of message data not recorded]\n", " P->U [24 bytes of message data not recorded]\n",
+		" C->P NOOP\n", " U->P 500 ",
+	}, user, password, "limit")
+
+	// Transcripts can be written to a directory
+	dir, err := ioutil.TempDir("", "transcripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := smtpproxy.NewTranscriptDir(filepath.Join(dir, "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteTranscript("abc123", []byte("transcript\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "sessions", "abc123.log")); err != nil || string(b) != "transcript\n" {
+		t.Errorf("Unexpected transcript file %q, %v", b, err)
+	}
+}
+
+// blackholeServer accepts connections but never sends a banner
+func blackholeServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn) // hold open, silently
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestInitContext(t *testing.T) {
+	ln := blackholeServer(t)
+	defer ln.Close()
+	be := smtpproxy.NewBackend(ln.Addr().String(), false, true)
+
+	// Cancelling the context abandons the wait for the upstream banner
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := be.InitContext(ctx, smtpproxy.ConnectionState{}); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("InitContext took %v to give up", d)
+	}
+
+	// A client stuck behind the blackholed upstream is released when shutdown runs out of time
+	s := smtpproxy.NewServer(be)
+	s.Addr = inHostPortBlackhole
+	s.Domain = "localhost"
+	go startProxy(t, s)
+	c := dialProxy(t, inHostPortBlackhole)
+	if err := c.Text.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // let the proxy start dialling
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+	if err := s.Shutdown(ctx2); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if code, msg, err := c.Text.ReadResponse(421); err != nil {
+		t.Errorf("Client got %d %s, %v", code, msg, err)
+	}
+	s.Close()
+}
+
+// expectResponse sends a raw command line and checks the response code
+func expectResponse(t *testing.T, c *smtp.Client, expectCode int, line string) {
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	if code, msg, err := c.Text.ReadResponse(expectCode); err != nil {
+		t.Errorf("%s: got %d %s, expected %d", line, code, msg, expectCode)
+	}
+}
+
+// sendOneEmail through an established client connection, then QUIT
+func sendOneEmail(t *testing.T, c *smtp.Client, secure string, mockReply chan []byte) {
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if secure == "STARTTLS" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			t.Fatal("STARTTLS not offered")
+		}
+		cfg, err := tlsClientConfig(localhostCert, localhostKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.StartTLS(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user@example.com", "password", "localhost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(RandomRecipient()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(RandomRecipient()); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEmail := RandomTestEmail()
+	if _, err := io.WriteString(w, testEmail); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	outputMail, err := mail.ReadMessage(bytes.NewReader(<-mockReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputMail, err := mail.ReadMessage(strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareInOutMail(t, inputMail, outputMail)
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+}
+
+// dialProxy connects to the proxy, allowing the server a little while to start
+func dialProxy(t *testing.T, hostPort string) *smtp.Client {
+	c, err := smtp.Dial(hostPort)
+	for i := 0; err != nil && i < 10; i++ {
+		time.Sleep(time.Millisecond * 100)
+		c, err = smtp.Dial(hostPort)
+	}
+	if err != nil {
+		t.Fatalf("Can't connect to proxy: %v\n", err)
+	}
+	return c
+}
+
 func sendAndCheckEmails(t *testing.T, inHostPort string, n int, secure string, mockReply chan []byte, makeEmail func() string) {
 	// Allow server a little while to start, then send a test mail using standard net/smtp.Client
 	c, err := smtp.Dial(inHostPort)
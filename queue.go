@@ -0,0 +1,481 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains functions for the proxy to store messages on disk and forward them later.
+
+// QueuedMessage is the envelope and delivery state of a message held in a Queue. It's stored as JSON alongside
+// the message content.
+type QueuedMessage struct {
+	ID          string
+	MailArg     string    // MAIL command argument, e.g. "FROM:<sender@example.com> BODY=8BITMIME"
+	RcptArgs    []string  // RCPT command arguments, for the recipients not yet delivered to
+	AuthUser    string    `json:",omitempty"` // locally authenticated client that sent the message
+	ClientAddr  string    `json:",omitempty"` // address of the client that sent the message
+	Created     time.Time // when the message was accepted
+	Attempts    int       // delivery attempts so far
+	NextAttempt time.Time
+	LastError   string          `json:",omitempty"` // response to the last failed attempt
+	Failed      []QueuedFailure `json:",omitempty"` // recipients not yet returned to the sender
+}
+
+// QueuedFailure is a recipient that failed permanently, or expired if Code is 0, with the last response
+type QueuedFailure struct {
+	RcptArg string
+	Code    int
+	Msg     string
+}
+
+// DeliverFunc attempts delivery of a queued message, whose content is read from body. It returns a response
+// for each of msg.RcptArgs, in order. A 2xx code means delivered, 5xx a permanent failure, and anything else
+// a temporary failure, to be retried.
+type DeliverFunc func(ctx context.Context, msg *QueuedMessage, body io.ReadSeeker) []Response
+
+// Queue is a durable on-disk spool of messages awaiting delivery. Each message is written to disk before it's
+// acknowledged, and stays there until every recipient has been delivered to or has failed, so the queue
+// survives restarts. Failed attempts are retried after MinRetry, doubling each time up to MaxRetry. Once a
+// message is older than MaxAge, or a recipient fails permanently, it's returned to the sender as a delivery
+// status notification (RFC 3464).
+type Queue struct {
+	MinRetry time.Duration // delay after the first failed attempt
+	MaxRetry time.Duration // longest delay between attempts
+	MaxAge   time.Duration // how long to keep trying before giving up
+	Hostname string        // names the proxy in delivery status notifications
+
+	dir     string
+	locker  sync.Mutex
+	pending map[string]time.Time // next attempt, by message ID
+	wake    chan struct{}        // signals a new message to the worker
+}
+
+// NewQueue opens the queue in dir, creating it if necessary, with default retry timings. Messages already
+// in dir are picked up for delivery.
+func NewQueue(dir string) (*Queue, error) {
+	q := &Queue{
+		MinRetry: time.Minute,
+		MaxRetry: time.Hour,
+		MaxAge:   5 * 24 * time.Hour,
+		dir:      dir,
+		pending:  make(map[string]time.Time),
+		wake:     make(chan struct{}, 1),
+	}
+	q.Hostname, _ = os.Hostname()
+	if q.Hostname == "" {
+		q.Hostname = "localhost"
+	}
+	// Anything left in tmp was never acknowledged to a client
+	if err := os.RemoveAll(q.tmpDir()); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(q.tmpDir(), 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		msg, err := q.load(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			log.Println("Queue: skipping", f, err.Error())
+			continue
+		}
+		q.pending[msg.ID] = msg.NextAttempt
+		if len(msg.Failed) > 0 {
+			q.pending[msg.ID] = time.Now() // a bounce is still to be sent
+		}
+	}
+	return q, nil
+}
+
+// Len returns the number of messages in the queue
+func (q *Queue) Len() int {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	return len(q.pending)
+}
+
+// Enqueue stores a message, read from r, with the envelope in msg. ID, Created and NextAttempt are filled in.
+// When Enqueue returns without error, the message is safely on disk. Returns the size of the message.
+func (q *Queue) Enqueue(msg *QueuedMessage, r io.Reader) (int64, error) {
+	if msg.ID == "" {
+		msg.ID = newQueueID()
+	}
+	msg.Created = time.Now()
+	msg.NextAttempt = msg.Created
+	tmp := filepath.Join(q.tmpDir(), msg.ID+".eml")
+	count, err := writeFileSync(tmp, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return count, err
+	}
+	if err = renameSync(tmp, q.path(msg.ID, ".eml")); err != nil {
+		os.Remove(tmp)
+		return count, err
+	}
+	// The envelope is written last, as its presence marks the message as queued
+	if err = q.save(msg); err != nil {
+		os.Remove(q.path(msg.ID, ".eml"))
+		return count, err
+	}
+	q.schedule(msg.ID, msg.NextAttempt)
+	return count, nil
+}
+
+// Run delivers queued messages, one at a time, as each falls due, until ctx is cancelled. Only one Run should
+// be active per Queue.
+func (q *Queue) Run(ctx context.Context, deliver DeliverFunc) error {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		id, due := q.next()
+		wait := time.Until(due)
+		if id == "" {
+			wait = time.Hour // nothing queued, so wait to be woken
+		}
+		if wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-q.wake:
+			case <-timer.C:
+			}
+			continue
+		}
+		if err := q.attempt(ctx, id, deliver); err != nil {
+			log.Println("Queue: message", id, "error", err.Error())
+			// Don't spin on a message that can't be read or updated
+			q.schedule(id, time.Now().Add(q.MinRetry))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// next returns the message due soonest, or "" if the queue is empty
+func (q *Queue) next() (string, time.Time) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	var id string
+	var due time.Time
+	for i, t := range q.pending {
+		if id == "" || t.Before(due) {
+			id, due = i, t
+		}
+	}
+	return id, due
+}
+
+// schedule sets when a message is next attempted, waking the worker
+func (q *Queue) schedule(id string, t time.Time) {
+	q.locker.Lock()
+	q.pending[id] = t
+	q.locker.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// attempt makes one delivery attempt of a message, then removes it, bounces it or schedules a retry
+func (q *Queue) attempt(ctx context.Context, id string, deliver DeliverFunc) error {
+	msg, err := q.load(id)
+	if os.IsNotExist(err) {
+		q.locker.Lock()
+		delete(q.pending, id) // removed from disk by someone else
+		q.locker.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(q.path(id, ".eml"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// A bounce left over from the last attempt is sent before delivering to anyone else
+	if len(msg.Failed) == 0 {
+		resps := deliver(ctx, msg, f)
+		msg.Attempts++
+
+		var retry []string
+		for i, arg := range msg.RcptArgs {
+			var r Response
+			if i < len(resps) {
+				r = resps[i]
+			}
+			switch {
+			case code2xxSuccess(r.Code):
+			case r.Code >= 500 && r.Code <= 599:
+				msg.Failed = append(msg.Failed, QueuedFailure{RcptArg: arg, Code: r.Code, Msg: r.Msg})
+			default:
+				retry = append(retry, arg)
+				msg.LastError = fmt.Sprintf("%d %s", r.Code, r.Msg)
+			}
+		}
+		delivered := len(msg.RcptArgs) - len(retry) - len(msg.Failed)
+		if len(retry) > 0 && time.Since(msg.Created) >= q.MaxAge {
+			for _, arg := range retry {
+				msg.Failed = append(msg.Failed, QueuedFailure{RcptArg: arg, Msg: msg.LastError})
+			}
+			retry = nil
+		}
+		log.Printf("Queue: message %s attempt %d, delivered %d, failed %d, deferred %d\n", id, msg.Attempts, delivered, len(msg.Failed), len(retry))
+		msg.RcptArgs = retry
+		msg.NextAttempt = time.Now().Add(q.backoff(msg.Attempts))
+
+		// Record who's been delivered to before bouncing, so if the bounce fails, only the bounce is retried
+		if len(msg.Failed) > 0 {
+			if err = q.save(msg); err != nil {
+				return err
+			}
+		}
+	}
+	if len(msg.Failed) > 0 {
+		if err = q.bounce(msg, f); err != nil {
+			return err
+		}
+		msg.Failed = nil
+	}
+	if len(msg.RcptArgs) == 0 {
+		q.locker.Lock()
+		delete(q.pending, id)
+		q.locker.Unlock()
+		os.Remove(q.path(id, ".json"))
+		return os.Remove(q.path(id, ".eml"))
+	}
+	if err = q.save(msg); err != nil {
+		return err
+	}
+	q.schedule(id, msg.NextAttempt)
+	return nil
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.MinRetry
+	for i := 1; i < attempts && d < q.MaxRetry; i++ {
+		d *= 2
+	}
+	if d > q.MaxRetry {
+		d = q.MaxRetry
+	}
+	return d
+}
+
+var enhancedCodeRe = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}`)
+
+// bounce queues a delivery status notification to the sender of msg, for its failed recipients. Messages with
+// a null sender, such as notifications themselves, are not bounced. The notification's ID is derived from the
+// attempt, so a retried bounce replaces, rather than duplicates, one that was partly queued.
+func (q *Queue) bounce(msg *QueuedMessage, content io.ReadSeeker) error {
+	from, _ := parsePath(msg.MailArg, "FROM:")
+	if from == "" {
+		log.Println("Queue: message", msg.ID, "has no sender to return it to, dropping")
+		return nil
+	}
+	boundary := "=_" + newQueueID()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", q.Hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", from)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", newQueueID(), q.Hostname)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n", boundary)
+	b.WriteString("Your message could not be delivered to the following recipients.\r\n\r\n")
+	for _, f := range msg.Failed {
+		rcpt, _ := parsePath(f.RcptArg, "TO:")
+		if f.Code == 0 {
+			fmt.Fprintf(&b, "<%s>: gave up after %d attempts, last error: %s\r\n", rcpt, msg.Attempts, f.Msg)
+		} else {
+			fmt.Fprintf(&b, "<%s>: %d %s\r\n", rcpt, f.Code, f.Msg)
+		}
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", q.Hostname)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", msg.Created.Format(time.RFC1123Z))
+	for _, f := range msg.Failed {
+		rcpt, _ := parsePath(f.RcptArg, "TO:")
+		status, diag := "4.4.7", "X-Proxy; message expired, last error: "+f.Msg
+		if f.Code != 0 {
+			status, diag = "5.0.0", fmt.Sprintf("smtp; %d %s", f.Code, f.Msg)
+			if ec := enhancedCodeRe.FindString(f.Msg); ec != "" {
+				status = ec
+			}
+		}
+		fmt.Fprintf(&b, "\r\nFinal-Recipient: rfc822; %s\r\nAction: failed\r\nStatus: %s\r\nDiagnostic-Code: %s\r\n", rcpt, status, diag)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(content)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" {
+			break // end of the headers
+		}
+		b.WriteString(line)
+		if err != nil {
+			b.WriteString("\r\n")
+			break
+		}
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+
+	dsn := &QueuedMessage{
+		ID:       fmt.Sprintf("%s-%d", msg.ID, msg.Attempts),
+		MailArg:  "FROM:<>",
+		RcptArgs: []string{"TO:<" + from + ">"},
+	}
+	if _, err := q.Enqueue(dsn, &b); err != nil {
+		return err
+	}
+	log.Println("Queue: message", msg.ID, "returned to sender as", dsn.ID)
+	return nil
+}
+
+func (q *Queue) tmpDir() string {
+	return filepath.Join(q.dir, "tmp")
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+// load reads a message's envelope and delivery state
+func (q *Queue) load(id string) (*QueuedMessage, error) {
+	b, err := ioutil.ReadFile(q.path(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	var msg QueuedMessage
+	if err = json.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+	if msg.ID != id {
+		return nil, fmt.Errorf("message ID %q doesn't match file name", msg.ID)
+	}
+	return &msg, nil
+}
+
+// save writes a message's envelope and delivery state, replacing any previous version atomically
+func (q *Queue) save(msg *QueuedMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.tmpDir(), msg.ID+".json")
+	if _, err = writeFileSync(tmp, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return renameSync(tmp, q.path(msg.ID, ".json"))
+}
+
+// writeFileSync creates a file with the content written by fill, flushing it to disk. Returns the file size.
+func writeFileSync(name string, fill func(w io.Writer) error) (int64, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: f}
+	err = fill(cw)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return cw.n, err
+}
+
+// renameSync renames a file, then flushes the directory it's moved to, so the new name survives a crash
+func renameSync(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return nil // Windows can't sync a directory
+	}
+	d, err := os.Open(filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// newQueueID returns a random identifier, usable as a file name
+func newQueueID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
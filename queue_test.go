@@ -0,0 +1,151 @@
+package smtpproxy_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+// runQueue runs q with deliver until it's empty, returning the delivery status notifications sent
+func runQueue(t *testing.T, q *smtpproxy.Queue, deliver smtpproxy.DeliverFunc) []string {
+	var locker sync.Mutex
+	var dsns []string
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx, func(ctx context.Context, msg *smtpproxy.QueuedMessage, body io.ReadSeeker) []smtpproxy.Response {
+			if msg.MailArg != "FROM:<>" {
+				return deliver(ctx, msg, body)
+			}
+			b, _ := ioutil.ReadAll(body)
+			locker.Lock()
+			dsns = append(dsns, string(b))
+			locker.Unlock()
+			return []smtpproxy.Response{{Code: 250, Msg: "2.0.0 OK"}}
+		})
+		close(done)
+	}()
+	for start := time.Now(); q.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Queue not emptied")
+		}
+	}
+	cancel()
+	<-done
+	return dsns
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := smtpproxy.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &smtpproxy.QueuedMessage{
+		MailArg:  "FROM:<sender@example.com>",
+		RcptArgs: []string{"TO:<a@example.com>", "TO:<b@example.com>"},
+	}
+	if _, err := q.Enqueue(msg, strings.NewReader("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is still there after a restart
+	q, err = smtpproxy.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Got %d queued messages, expected 1", q.Len())
+	}
+	q.MinRetry = 10 * time.Millisecond
+
+	// One recipient fails permanently and is bounced, the other is retried until it succeeds
+	var attempts []string
+	dsns := runQueue(t, q, func(ctx context.Context, msg *smtpproxy.QueuedMessage, body io.ReadSeeker) []smtpproxy.Response {
+		if b, _ := ioutil.ReadAll(body); string(b) != "Subject: test\r\n\r\nHello\r\n" {
+			t.Errorf("Unexpected message %q", b)
+		}
+		attempts = append(attempts, strings.Join(msg.RcptArgs, " "))
+		if len(attempts) == 1 {
+			return []smtpproxy.Response{{Code: 451, Msg: "4.3.0 try later"}, {Code: 550, Msg: "5.1.1 no such user"}}
+		}
+		return []smtpproxy.Response{{Code: 250, Msg: "2.0.0 OK"}}
+	})
+	expected := []string{"TO:<a@example.com> TO:<b@example.com>", "TO:<a@example.com>"}
+	if strings.Join(attempts, ",") != strings.Join(expected, ",") {
+		t.Errorf("Got attempts %q, expected %q", attempts, expected)
+	}
+	if len(dsns) != 1 {
+		t.Fatalf("Got %d delivery status notifications, expected 1", len(dsns))
+	}
+	for _, s := range []string{"To: <sender@example.com>", "Final-Recipient: rfc822; b@example.com", "Status: 5.1.1", "Subject: test"} {
+		if !strings.Contains(dsns[0], s) {
+			t.Errorf("Expected %q in notification %q", s, dsns[0])
+		}
+	}
+
+	// Messages that can't be delivered within MaxAge are returned to the sender
+	q.MaxAge = 0
+	if _, err := q.Enqueue(msg, strings.NewReader("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	dsns = runQueue(t, q, func(ctx context.Context, msg *smtpproxy.QueuedMessage, body io.ReadSeeker) []smtpproxy.Response {
+		return []smtpproxy.Response{{Code: 451, Msg: "4.3.0 try later"}, {Code: 451, Msg: "4.3.0 try later"}}
+	})
+	if len(dsns) != 1 || strings.Count(dsns[0], "Status: 4.4.7") != 2 {
+		t.Errorf("Expected notification of expiry for both recipients, got %q", dsns)
+	}
+}
+
+func TestQueueBounceError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := smtpproxy.NewQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MinRetry = 10 * time.Millisecond
+	msg := &smtpproxy.QueuedMessage{
+		MailArg:  "FROM:<sender@example.com>",
+		RcptArgs: []string{"TO:<a@example.com>", "TO:<b@example.com>"},
+	}
+	if _, err := q.Enqueue(msg, strings.NewReader("Subject: test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of the notification makes the first few bounces fail
+	block := filepath.Join(dir, msg.ID+"-1.eml")
+	if err := os.Mkdir(block, 0700); err != nil {
+		t.Fatal(err)
+	}
+	var attempts []string
+	dsns := runQueue(t, q, func(ctx context.Context, msg *smtpproxy.QueuedMessage, body io.ReadSeeker) []smtpproxy.Response {
+		attempts = append(attempts, strings.Join(msg.RcptArgs, " "))
+		time.AfterFunc(50*time.Millisecond, func() { os.Remove(block) })
+		return []smtpproxy.Response{{Code: 250, Msg: "2.0.0 OK"}, {Code: 550, Msg: "5.1.1 no such user"}}
+	})
+
+	// Only the bounce is retried, and the delivered recipient isn't sent the message again
+	if len(attempts) != 1 {
+		t.Errorf("Got attempts %q, expected 1", attempts)
+	}
+	if len(dsns) != 1 || !strings.Contains(dsns[0], "Final-Recipient: rfc822; b@example.com") ||
+		strings.Contains(dsns[0], "a@example.com") {
+		t.Errorf("Expected one notification for b@example.com, got %q", dsns)
+	}
+}
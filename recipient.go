@@ -0,0 +1,229 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// This file contains functions for the proxy to choose the upstream server per mail transaction, from the envelope.
+
+// RecipientRouter returns the upstream host:ports for a mail transaction, in the order to try them, given the
+// MAIL FROM and RCPT TO addresses. It's called for each recipient. Recipients routed differently from the first
+// in the transaction are deferred, so the client sends them again separately. Returning an error refuses the
+// recipient. An *SMTPError is sent to the client as-is, others as a 451.
+type RecipientRouter func(ctx context.Context, from, rcpt string) ([]string, error)
+
+// MXResolver looks up the DNS records needed for direct delivery. *net.Resolver implements it
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// MXRouter returns a RecipientRouter delivering directly to the mail exchangers of each recipient's domain, on
+// the given port, usually "25". Exchangers are tried in preference order. A domain without MX records is its own
+// mail exchanger, as per RFC 5321. If resolver is nil, net.DefaultResolver is used.
+func MXRouter(resolver MXResolver, port string) RecipientRouter {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return func(ctx context.Context, from, rcpt string) ([]string, error) {
+		domain := addressDomain(rcpt)
+		if domain == "" {
+			return nil, &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 3}, Message: "Recipient address must include a domain"}
+		}
+		mxs, err := resolver.LookupMX(ctx, domain)
+		if isNotFound(err) {
+			// No MX records, so fall back to the domain's own address, if it has one
+			if _, err = resolver.LookupHost(ctx, domain); err == nil {
+				return []string{net.JoinHostPort(domain, port)}, nil
+			}
+		}
+		if isNotFound(err) {
+			return nil, &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 2}, Message: "Recipient domain not found"}
+		}
+		if err != nil {
+			return nil, &SMTPError{Code: 451, EnhancedCode: EnhancedCode{4, 4, 3}, Message: "Temporary DNS failure for recipient domain"}
+		}
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			// RFC 7505 null MX
+			return nil, &SMTPError{Code: 556, EnhancedCode: EnhancedCode{5, 1, 10}, Message: "Recipient domain does not accept mail"}
+		}
+		// Order consistently, so that domains sharing mail exchangers are routed alike
+		sort.SliceStable(mxs, func(i, j int) bool {
+			if mxs[i].Pref != mxs[j].Pref {
+				return mxs[i].Pref < mxs[j].Pref
+			}
+			return mxs[i].Host < mxs[j].Host
+		})
+		addrs := make([]string, len(mxs))
+		for i, mx := range mxs {
+			addrs[i] = net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), port)
+		}
+		return addrs, nil
+	}
+}
+
+// ErrRelayDenied is returned by a RecipientRouter to refuse a recipient
+var ErrRelayDenied = &SMTPError{
+	Code:         550,
+	EnhancedCode: EnhancedCode{5, 7, 1},
+	Message:      "Relay access denied",
+}
+
+// DomainRoute sends mail for matching domains to the upstream HostPorts, tried in order. An empty HostPorts
+// refuses the mail.
+//
+// Pattern matches the recipient domain, or with Sender set, the MAIL FROM domain. It's either an exact domain
+// such as "example.com", a wildcard such as "*.example.com", or a regular expression between slashes such as
+// "/^mail[0-9]+\.example\.com$/". Matching is case insensitive.
+type DomainRoute struct {
+	Pattern   string
+	Sender    bool
+	HostPorts []string
+}
+
+// compiledRoute is a DomainRoute ready for matching
+type compiledRoute struct {
+	DomainRoute
+	re *regexp.Regexp
+}
+
+func (r *compiledRoute) match(domain string) bool {
+	if r.re != nil {
+		return r.re.MatchString(domain)
+	}
+	ok, _ := path.Match(r.Pattern, domain)
+	return ok
+}
+
+// DomainRouter returns a RecipientRouter choosing the upstream from a routing table. The first matching route
+// wins. Mail matching no route goes to def, or is refused if def is empty.
+func DomainRouter(routes []DomainRoute, def []string) (RecipientRouter, error) {
+	compiled := make([]compiledRoute, len(routes))
+	for i, r := range routes {
+		compiled[i].DomainRoute = r
+		if len(r.Pattern) > 1 && strings.HasPrefix(r.Pattern, "/") && strings.HasSuffix(r.Pattern, "/") {
+			re, err := regexp.Compile("(?i)" + r.Pattern[1:len(r.Pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+			compiled[i].re = re
+			continue
+		}
+		compiled[i].Pattern = strings.ToLower(r.Pattern)
+		if _, err := path.Match(compiled[i].Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Pattern, err)
+		}
+	}
+	return func(ctx context.Context, from, rcpt string) ([]string, error) {
+		hostPorts := def
+		for _, r := range compiled {
+			domain := addressDomain(rcpt)
+			if r.Sender {
+				domain = addressDomain(from)
+			}
+			if r.match(domain) {
+				hostPorts = r.HostPorts
+				break
+			}
+		}
+		if len(hostPorts) == 0 {
+			return nil, ErrRelayDenied
+		}
+		return hostPorts, nil
+	}, nil
+}
+
+// LoadDomainRoutes reads a routing table from disk. See ReadDomainRoutes
+func LoadDomainRoutes(filename string) (RecipientRouter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadDomainRoutes(f)
+}
+
+// ReadDomainRoutes reads "pattern host:port[,host:port...]" lines into a DomainRouter, e.g.
+// "*.corp.example.com relay.corp.example.com:25". Patterns match the recipient domain, or the MAIL FROM
+// domain if prefixed with "from:". A pattern of * sets the default route, and a host:port of "reject" refuses
+// the mail. Blank lines and lines starting with # are ignored.
+func ReadDomainRoutes(r io.Reader) (RecipientRouter, error) {
+	var routes []DomainRoute
+	var def []string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected pattern and host:port", lineNum)
+		}
+		var hostPorts []string
+		if fields[1] != "reject" {
+			hostPorts = strings.Split(fields[1], ",")
+		}
+		if fields[0] == "*" {
+			def = hostPorts
+			continue
+		}
+		route := DomainRoute{Pattern: fields[0], HostPorts: hostPorts}
+		if strings.HasPrefix(strings.ToLower(route.Pattern), "from:") {
+			route.Pattern = route.Pattern[len("from:"):]
+			route.Sender = true
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	router, err := DomainRouter(routes, def)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %v", err)
+	}
+	return router, nil
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// addressDomain returns the lowercased domain part of an email address, or "" if it has none
+func addressDomain(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[i+1:], "."))
+}
+
+// parsePath returns the address from a MAIL or RCPT argument, e.g. "TO:<user@example.com> NOTIFY=NEVER".
+// ok is false if the argument doesn't start with the given prefix, e.g. "TO:"
+func parsePath(arg, prefix string) (addr string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if strings.HasPrefix(arg, "<") {
+		if i := strings.Index(arg, ">"); i >= 0 {
+			return arg[1:i], true
+		}
+		return "", false
+	}
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		arg = arg[:i]
+	}
+	return arg, true
+}
@@ -0,0 +1,128 @@
+package smtpproxy_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+// fakeResolver answers MX and host lookups from tables, instead of DNS
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if name == "servfail.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMXRouter(t *testing.T) {
+	router := smtpproxy.MXRouter(&fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx2.example.com.", Pref: 20},
+				{Host: "mx1b.example.com.", Pref: 10},
+				{Host: "mx1a.example.com.", Pref: 10},
+			},
+			"nullmx.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"implicit.example": {"192.0.2.1"}},
+	}, "25")
+
+	type rcptResult struct {
+		rcpt  string
+		addrs string
+		code  int
+	}
+	for _, v := range []rcptResult{
+		{"user@Example.COM", "mx1a.example.com:25,mx1b.example.com:25,mx2.example.com:25", 0},
+		{"user@implicit.example", "implicit.example:25", 0},
+		{"user@nullmx.example", "", 556},
+		{"user@nonexistent.example", "", 550},
+		{"user@servfail.example", "", 451},
+		{"postmaster", "", 550},
+	} {
+		addrs, err := router(context.Background(), "sender@example.org", v.rcpt)
+		if v.code == 0 {
+			if err != nil || strings.Join(addrs, ",") != v.addrs {
+				t.Errorf("%s: got %v, %v, expected %s", v.rcpt, addrs, err, v.addrs)
+			}
+			continue
+		}
+		var smtpErr *smtpproxy.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != v.code {
+			t.Errorf("%s: got %v, %v, expected code %d", v.rcpt, addrs, err, v.code)
+		}
+	}
+}
+
+func TestDomainRoutes(t *testing.T) {
+	routeFile := "# test routes\n" +
+		"corp.example       internal.example:25\n" +
+		"*.corp.example     internal.example:25\n" +
+		"/^lab[0-9]+\\.example$/ lab.example:25,lab-backup.example:25\n" +
+		"from:alerts.example alerts-relay.example:587\n" +
+		"blocked.example    reject\n" +
+		"\n" +
+		"*                  esp.example:587\n"
+	router, err := smtpproxy.ReadDomainRoutes(strings.NewReader(routeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type envelopeResult struct {
+		from, rcpt string
+		addrs      string
+	}
+	for _, v := range []envelopeResult{
+		{"a@example.org", "b@CORP.example", "internal.example:25"},
+		{"a@example.org", "b@mail.corp.example", "internal.example:25"},
+		{"a@example.org", "b@notcorp.example", "esp.example:587"},
+		{"a@example.org", "b@lab42.example", "lab.example:25,lab-backup.example:25"},
+		{"a@example.org", "b@lab.example", "esp.example:587"},
+		{"a@alerts.example", "b@example.com", "alerts-relay.example:587"},
+		{"a@alerts.example", "b@corp.example", "internal.example:25"}, // earlier rule wins
+		{"a@example.org", "b@blocked.example", ""},
+	} {
+		addrs, err := router(context.Background(), v.from, v.rcpt)
+		if v.addrs == "" {
+			if err != smtpproxy.ErrRelayDenied {
+				t.Errorf("%s -> %s: expected refusal, got %v, %v", v.from, v.rcpt, addrs, err)
+			}
+		} else if err != nil || strings.Join(addrs, ",") != v.addrs {
+			t.Errorf("%s -> %s: got %v, %v, expected %s", v.from, v.rcpt, addrs, err, v.addrs)
+		}
+	}
+
+	// Without a default route, unmatched mail is refused
+	router, err = smtpproxy.ReadDomainRoutes(strings.NewReader("corp.example internal.example:25\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router(context.Background(), "a@example.org", "b@example.com"); err != smtpproxy.ErrRelayDenied {
+		t.Errorf("Expected refusal, got %v", err)
+	}
+
+	for _, bad := range []string{"corp.example\n", "/[/ relay:25\n", "[ relay:25\n"} {
+		if _, err := smtpproxy.ReadDomainRoutes(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected error for malformed line %q", bad)
+		}
+	}
+}
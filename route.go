@@ -0,0 +1,121 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// This file contains functions for the proxy to choose an upstream server per downstream client.
+
+// ErrClientRejected is returned by an UpstreamRouter to refuse service to a client
+var ErrClientRejected = &SMTPError{
+	Code:         554,
+	EnhancedCode: EnhancedCode{5, 7, 1},
+	Message:      "Client host rejected",
+}
+
+// UpstreamRouter returns the upstream host:port to use for a downstream client. It is called once per session,
+// on the first HELO/EHLO, so state.Hostname is set but state.TLS reflects only implicit TLS, not a later STARTTLS.
+// Returning an error rejects the client. An *SMTPError is sent to the client as-is, others as a 421.
+type UpstreamRouter func(state ConnectionState) (string, error)
+
+// SubnetRoute sends clients within Net to the upstream HostPort. An empty HostPort rejects them.
+type SubnetRoute struct {
+	Net      *net.IPNet
+	HostPort string
+}
+
+// SubnetRouter returns an UpstreamRouter choosing by the client's source address. The most specific
+// matching route wins. Clients matching no route, or without an IP address (e.g. on a Unix socket),
+// go to def, or are rejected if def is empty.
+func SubnetRouter(routes []SubnetRoute, def string) UpstreamRouter {
+	sorted := make([]SubnetRoute, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		oi, _ := sorted[i].Net.Mask.Size()
+		oj, _ := sorted[j].Net.Mask.Size()
+		return oi > oj
+	})
+	return func(state ConnectionState) (string, error) {
+		hostPort := def
+		if ip := remoteIP(state.RemoteAddr); ip != nil {
+			for _, r := range sorted {
+				if r.Net.Contains(ip) {
+					hostPort = r.HostPort
+					break
+				}
+			}
+		}
+		if hostPort == "" {
+			return "", ErrClientRejected
+		}
+		return hostPort, nil
+	}
+}
+
+// remoteIP returns the IP address of a downstream client, or nil if it doesn't have one
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// LoadSubnetRoutes reads a routing table from disk. See ReadSubnetRoutes
+func LoadSubnetRoutes(filename string) (UpstreamRouter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSubnetRoutes(f)
+}
+
+// ReadSubnetRoutes reads "subnet host:port" lines into a SubnetRouter, where subnet is in CIDR notation, e.g.
+// "10.1.0.0/16 smtp.example.com:587". A subnet of * sets the default route, and a host:port of "reject"
+// refuses service. Blank lines and lines starting with # are ignored.
+func ReadSubnetRoutes(r io.Reader) (UpstreamRouter, error) {
+	var routes []SubnetRoute
+	var def string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected subnet and host:port", lineNum)
+		}
+		hostPort := fields[1]
+		if hostPort == "reject" {
+			hostPort = ""
+		}
+		if fields[0] == "*" {
+			def = hostPort
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		routes = append(routes, SubnetRoute{Net: ipNet, HostPort: hostPort})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return SubnetRouter(routes, def), nil
+}
@@ -0,0 +1,61 @@
+package smtpproxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+func TestSubnetRoutes(t *testing.T) {
+	routeFile := "# test routes\n" +
+		"10.0.0.0/8     smtp.a.example:587\n" +
+		"10.1.0.0/16    smtp.b.example:587\n" +
+		"\n" +
+		"192.168.0.0/16 reject\n" +
+		"fd00::/8       smtp.c.example:25\n" +
+		"*              smtp.default.example:587\n"
+	router, err := smtpproxy.ReadSubnetRoutes(strings.NewReader(routeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type addrResult struct {
+		addr     net.Addr
+		hostPort string
+	}
+	for _, v := range []addrResult{
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1234}, "smtp.a.example:587"},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.3.4"), Port: 1234}, "smtp.b.example:587"},
+		{&net.TCPAddr{IP: net.ParseIP("fd12::1"), Port: 1234}, "smtp.c.example:25"},
+		{&net.TCPAddr{IP: net.ParseIP("172.16.0.1"), Port: 1234}, "smtp.default.example:587"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "smtp.default.example:587"},
+		{nil, "smtp.default.example:587"},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, ""},
+	} {
+		hostPort, err := router(smtpproxy.ConnectionState{RemoteAddr: v.addr})
+		if v.hostPort == "" {
+			if err != smtpproxy.ErrClientRejected {
+				t.Errorf("%v: expected rejection, got %s, %v", v.addr, hostPort, err)
+			}
+		} else if hostPort != v.hostPort || err != nil {
+			t.Errorf("%v: got %s, %v, expected %s", v.addr, hostPort, err, v.hostPort)
+		}
+	}
+
+	// Without a default route, unmatched clients are rejected
+	router, err = smtpproxy.ReadSubnetRoutes(strings.NewReader("10.0.0.0/8 smtp.a.example:587\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router(smtpproxy.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}); err != smtpproxy.ErrClientRejected {
+		t.Errorf("Expected rejection, got %v", err)
+	}
+
+	for _, bad := range []string{"10.0.0.0/8\n", "10.0.0.0/33 smtp.a.example:587\n", "10.0.0.0/8 a b\n"} {
+		if _, err := smtpproxy.ReadSubnetRoutes(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected error for malformed line %q", bad)
+		}
+	}
+}
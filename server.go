@@ -2,6 +2,7 @@
 package smtpproxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -10,11 +11,18 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var errTCPAndLMTP = errors.New("smtp: cannot start LMTP server listening on a TCP socket")
 
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("smtp: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for idle connections to close
+const shutdownPollInterval = 100 * time.Millisecond
+
 // Logger interface is used by Server to report unexpected internal errors.
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -30,34 +38,60 @@ type Server struct {
 
 	Domain string
 
+	// Debug, if set, receives the transcript of each session as it ends, with each line tagged with the session ID
 	Debug        io.Writer
 	ErrorLog     Logger
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// Transcripts, if set, records a transcript of each session, covering the client and upstream connections
+	Transcripts *TranscriptRecorder
+
+	// CapsPolicy, if set, can add, remove or rewrite the EHLO capabilities offered to each client
+	CapsPolicy CapsPolicy
+
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
 	AuthDisabled bool
 
+	// If set, AUTH is offered and accepted on connections that are not using TLS.
+	// NewServer enables this, so credentials pass through as the client sends them.
+	AllowInsecureAuth bool
+
+	// AuthMechanisms, if not empty, restricts the SASL mechanisms offered to and accepted
+	// from clients, e.g. PLAIN, LOGIN, CRAM-MD5, XOAUTH2.
+	AuthMechanisms []string
+
+	// LMTP mode (RFC 2033): clients greet with LHLO, and DATA is answered with a response per accepted
+	// recipient. ListenAndServe then listens on a Unix socket at Addr.
+	LMTP bool
+
+	// Metrics, if set, counts client connections and STARTTLS
+	Metrics *Metrics
+
 	// The server backend.
 	Backend Backend
 
 	listener net.Listener
-	caps     []string
+	ctx      context.Context    // parent of each connection's context
+	cancel   context.CancelFunc // cancels ctx, abandoning all sessions
+	caps     []string           // default capabilities, used when the upstream reports none
 
 	//auths no longer using sasl library
 
-	locker sync.Mutex
-	conns  map[*Conn]struct{}
+	locker     sync.Mutex
+	conns      map[*Conn]struct{}
+	inShutdown int32 // accessed atomically, non-zero once Shutdown or Close is called
 }
 
 // NewServer creates a new SMTP server, with a Backend interface, supporting many connections
 func NewServer(be Backend) *Server {
 	return &Server{
-		Backend:  be,
-		ErrorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
-		caps:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"},
-		conns:    make(map[*Conn]struct{}),
+		Backend:           be,
+		ErrorLog:          log.New(os.Stderr, "smtp/server ", log.LstdFlags),
+		AllowInsecureAuth: true,
+		caps:              []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"},
+		conns:             make(map[*Conn]struct{}),
 	}
 }
 
@@ -80,16 +114,26 @@ func (s *Server) ServeTLS(cert []byte, privkey []byte) error {
 
 // Serve accepts incoming connections on the Listener l.
 func (s *Server) Serve(l net.Listener) error {
+	s.locker.Lock()
 	s.listener = l
-	defer s.Close()
+	s.locker.Unlock()
+	defer func() {
+		// Connections are left to drain if we're shutting down gracefully
+		if !s.shuttingDown() {
+			s.Close()
+		}
+	}()
 
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		go s.handleConn(newConn(c, s))
+		go s.handleConn(newConn(c, s, s.baseContext()))
 	}
 }
 
@@ -97,20 +141,40 @@ func (s *Server) Serve(l net.Listener) error {
 func (s *Server) handleConn(c *Conn) error {
 	s.locker.Lock()
 	s.conns[c] = struct{}{}
+	s.Metrics.connOpened(len(s.conns))
 	s.locker.Unlock()
 
 	defer func() {
+		c.quitSession()
 		c.Close()
+		c.endTranscript()
 
 		s.locker.Lock()
 		delete(s.conns, c)
+		s.Metrics.connClosed(len(s.conns))
 		s.locker.Unlock()
 	}()
 
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		// Implicit TLS - complete the handshake before greeting the client
+		if s.ReadTimeout != 0 {
+			tlsConn.SetDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			s.ErrorLog.Printf("TLS handshake error from %v: %v", c.conn.RemoteAddr(), err)
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
 	c.greet()
 
 	for {
 		line, err := c.ReadLine()
+		// Once shutting down, sessions between transactions are told to go away
+		if s.shuttingDown() && !c.inTransaction() {
+			c.WriteResponse(421, EnhancedCode{4, 3, 2}, "Service shutting down, try again later")
+			return nil
+		}
 		if err == nil {
 			cmd, arg, err := ParseCmd(line)
 			if err != nil {
@@ -142,9 +206,9 @@ func (s *Server) handleConn(c *Conn) error {
 // If s.Addr is blank and LMTP is disabled, ":smtp" is used.
 func (s *Server) ListenAndServe() error {
 	network := "tcp"
-	/* if s.LMTP {
+	if s.LMTP {
 		network = "unix"
-	} */
+	}
 
 	addr := s.Addr
 	if addr == "" {
@@ -159,16 +223,106 @@ func (s *Server) ListenAndServe() error {
 	return s.Serve(l)
 }
 
-// Close function not needed
+// ListenAndServeTLS listens on the network address s.Addr with implicit TLS (SMTPS), using
+// s.TLSConfig, and then calls Serve. Connections are encrypted from the outset, so STARTTLS
+// is not offered to clients.
+//
+// If s.Addr is blank, ":465" is used.
+func (s *Server) ListenAndServeTLS() error {
+	if s.LMTP {
+		return errTCPAndLMTP
+	}
+	if s.TLSConfig == nil {
+		return errors.New("smtp: implicit TLS requires TLSConfig")
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = ":465"
+	}
+
+	l, err := tls.Listen("tcp", addr, s.TLSConfig)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Close stops the server immediately, closing the listener and all connections.
+// Messages in flight are lost; see Shutdown for a graceful alternative.
 func (s *Server) Close() {
-	s.listener.Close()
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.baseContext()
+	s.cancel()
 
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
+	if s.listener != nil {
+		s.listener.Close()
+	}
 	for conn := range s.conns {
 		conn.Close()
 	}
 }
 
+// Shutdown gracefully shuts down the server. It stops accepting new connections,
+// lets transactions already in progress run to completion, then replies 421 to idle
+// sessions and sends QUIT upstream on their behalf.
+//
+// Shutdown returns once all connections have drained. If ctx expires first, the
+// sessions' contexts are cancelled and the context's error is returned. Any remaining
+// connections are left open; call Close to drop them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.locker.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.locker.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.wakeIdleConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.baseContext()
+			s.cancel()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// wakeIdleConns interrupts connections waiting for a command between transactions, so they
+// notice the shutdown. Returns the number of connections still open.
+func (s *Server) wakeIdleConns() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for conn := range s.conns {
+		conn.wakeIfIdle()
+	}
+	return len(s.conns)
+}
+
+// baseContext returns the context that connections are derived from, creating it if needed
+func (s *Server) baseContext() context.Context {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
 // ForEachConn not needed
@@ -0,0 +1,145 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// This file contains the trace headers the proxy can add to each message it receives.
+
+// TraceHeaders chooses the headers added to the top of each message, identifying the transaction it was sent in.
+// The transaction ID is the one in the proxy's logs, and the queue ID when messages are queued.
+// Set MaxHops to reject messages that have passed through too many hosts, as they are probably looping.
+// RFC 5321 section 6.3 suggests a limit of at least 100.
+type TraceHeaders struct {
+	Domain        string // name of this host, as given in Received headers
+	Received      bool   // add a Received header
+	TransactionID bool   // add an X-Proxy-Transaction-ID header
+	MaxHops       int    // if > 0, messages with more Received headers than this are rejected
+}
+
+// traceHeaders returns the headers to add to the message of the current transaction, with lines ending in eol
+func (s *proxySession) traceHeaders(eol string) string {
+	t := s.bkd.trace
+	if t == nil || s.delivery {
+		return ""
+	}
+	var b strings.Builder
+	if t.Received {
+		b.WriteString(s.received(t.Domain, time.Now(), eol))
+	}
+	if t.TransactionID {
+		fmt.Fprintf(&b, "X-Proxy-Transaction-ID: %s%s", s.txnID, eol)
+	}
+	return b.String()
+}
+
+// received returns a Received header for the current transaction, as RFC 5321 section 4.4 describes, with lines
+// ending in eol. It's folded before each clause, with the TLS version and cipher as a comment if the client used TLS.
+func (s *proxySession) received(domain string, now time.Time, eol string) string {
+	from := s.state.Hostname
+	if from == "" {
+		from = "unknown"
+	}
+	var ip string
+	if addr, ok := s.state.RemoteAddr.(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+		if addr.IP.To4() == nil {
+			ip = "IPv6:" + ip
+		}
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+	h := "Received: from " + headerSafe(from)
+	if ip != "" {
+		h += " ([" + ip + "])"
+	}
+	if tlsState := s.state.TLS; tlsState.HandshakeComplete {
+		h += eol + "\t(using " + tlsVersion(tlsState, true) + " with cipher " + tls.CipherSuiteName(tlsState.CipherSuite) + ")"
+	}
+	h += eol + "\tby " + domain + " with " + s.receivedProtocol() + " id " + s.txnID + ";"
+	return h + eol + "\t" + now.Format(time.RFC1123Z) + eol
+}
+
+// receivedProtocol returns the protocol the message was received with, as named in RFC 3848
+func (s *proxySession) receivedProtocol() string {
+	var proto string
+	switch s.state.HeloCommand {
+	case "EHLO":
+		proto = "ESMTP"
+	case "LHLO":
+		proto = "LMTP"
+	default:
+		return "SMTP"
+	}
+	if s.state.TLS.HandshakeComplete {
+		proto += "S"
+	}
+	if s.authUser != "" || s.relayAuth {
+		proto += "A"
+	}
+	return proto
+}
+
+// checkingHops reports whether messages in this session are checked for loops before they're sent on
+func (s *proxySession) checkingHops() bool {
+	return s.bkd.trace != nil && s.bkd.trace.MaxHops > 0 && !s.delivery
+}
+
+// checkHops rejects the message read from r if it has too many Received headers, resetting any transaction
+// upstream. Otherwise, it returns a reader of the whole message.
+func (s *proxySession) checkHops(r io.Reader) (io.Reader, int, string, error) {
+	hops, r, err := countReceived(r)
+	if err != nil {
+		s.loggerAlways("Message read error", err.Error())
+		return nil, 451, "4.3.0 Unable to read message", err
+	}
+	if hops <= s.bkd.trace.MaxHops {
+		return r, 0, "", nil
+	}
+	s.loggerAlways("Message rejected as looping, Received headers =", hops)
+	s.resetUpstream()
+	msg := "5.4.6 Too many hops, message is looping"
+	return nil, 554, msg, errors.New(msg)
+}
+
+// maxHopHeaderBytes is the most of a message read while counting its Received headers
+const maxHopHeaderBytes = 1 << 20
+
+// countReceived reads the header section of a message from r, counting its Received headers. It returns a reader
+// of the whole message, including the part already read.
+func countReceived(r io.Reader) (int, io.Reader, error) {
+	br := bufio.NewReader(r)
+	var head bytes.Buffer
+	hops := 0
+	lineStart := true
+	for head.Len() < maxHopHeaderBytes {
+		line, err := br.ReadSlice('\n')
+		head.Write(line)
+		if lineStart {
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				break // end of the header section
+			}
+			if len(line) >= 9 && strings.EqualFold(string(line[:9]), "Received:") {
+				hops++
+			}
+		}
+		lineStart = err == nil // a longer line carries on, otherwise the next one starts
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return 0, nil, err
+		}
+	}
+	return hops, io.MultiReader(&head, br), nil
+}
@@ -0,0 +1,239 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// This file contains a message filter for open and click tracking, and the HTTP handler for its links.
+
+// Tracking actions, which are also the path segment of a tracking link
+const (
+	TrackOpen  = "open"
+	TrackClick = "click"
+)
+
+// TrackingData is carried, encoded, in each tracking link
+type TrackingData struct {
+	Action    string `json:"act"`
+	TargetURL string `json:"t_url,omitempty"`
+	MessageID string `json:"msg_id"`
+	Rcpt      string `json:"rcpt,omitempty"`
+}
+
+// Tracker is a MessageFilter that adds open and click tracking to the HTML parts of messages. Links are rewritten to
+// go through URL, and a tracking pixel is added before </body>. Text parts are left alone. Serve Handler at URL to
+// record the events and redirect clicks on to the original links.
+//
+// Each link carries the message's Message-ID, and the recipient when a message has just one. Messages sent to
+// several recipients at once can't tell them apart.
+type Tracker struct {
+	URL    string // base URL of the handler, e.g. https://track.example.com/t
+	Key    []byte // signs tracking links, so the handler only redirects to links it made. If nil, links are unsigned, and clicks aren't redirected
+	Opens  bool   // add a tracking pixel
+	Clicks bool   // rewrite links
+}
+
+// NewTracker returns a Tracker of opens and clicks, with links through url, signed by key
+func NewTracker(url string, key []byte) *Tracker {
+	return &Tracker{
+		URL:    strings.TrimRight(url, "/"),
+		Key:    key,
+		Opens:  true,
+		Clicks: true,
+	}
+}
+
+// linkRe matches the start of an anchor tag, up to and including its href value
+var linkRe = regexp.MustCompile(`(?is)(<a\s[^>]*?\bhref\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// bodyEndRe matches the end of the HTML body
+var bodyEndRe = regexp.MustCompile(`(?i)</body\s*>`)
+
+// Filter adds tracking to a message
+func (t *Tracker) Filter(env *Envelope, h *Header, body io.Reader) (io.Reader, error) {
+	msgID := strings.Trim(h.Get("Message-ID"), "<> ")
+	if msgID == "" {
+		msgID = newQueueID()
+	}
+	rcpt := ""
+	if len(env.RcptTo) == 1 {
+		rcpt = env.RcptTo[0]
+	}
+	var out bytes.Buffer
+	err := RewriteMIME(h, body, &out, func(mediaType string, ph *Header, r io.Reader, w io.Writer) error {
+		if mediaType != "text/html" {
+			_, err := io.Copy(w, r)
+			return err
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, t.TrackHTML(string(b), msgID, rcpt))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// TrackHTML adds tracking to an HTML document
+func (t *Tracker) TrackHTML(doc, msgID, rcpt string) string {
+	if t.Clicks {
+		doc = linkRe.ReplaceAllStringFunc(doc, func(tag string) string {
+			m := linkRe.FindStringSubmatch(tag)
+			quote, target := `"`, m[2]
+			if strings.HasPrefix(tag[len(m[1]):], "'") {
+				quote, target = "'", m[3]
+			}
+			target = strings.TrimSpace(html.UnescapeString(target))
+			lower := strings.ToLower(target)
+			if !(strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")) || strings.HasPrefix(target, t.URL+"/") {
+				return tag // mailto: and the like, or already tracked
+			}
+			link := t.Link(&TrackingData{Action: TrackClick, TargetURL: target, MessageID: msgID, Rcpt: rcpt})
+			return m[1] + quote + html.EscapeString(link) + quote
+		})
+	}
+	if t.Opens {
+		pixel := `<img src="` + html.EscapeString(t.Link(&TrackingData{Action: TrackOpen, MessageID: msgID, Rcpt: rcpt})) +
+			`" width="1" height="1" border="0" alt="">`
+		if loc := bodyEndRe.FindAllStringIndex(doc, -1); loc != nil {
+			i := loc[len(loc)-1][0]
+			doc = doc[:i] + pixel + doc[i:]
+		} else {
+			doc += pixel
+		}
+	}
+	return doc
+}
+
+// Link returns the tracking link for d
+func (t *Tracker) Link(d *TrackingData) string {
+	b, _ := json.Marshal(d) // can't fail for this type
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if t.Key != nil {
+		id += "." + base64.RawURLEncoding.EncodeToString(t.sign(id))
+	}
+	return t.URL + "/" + d.Action + "/" + id
+}
+
+func (t *Tracker) sign(id string) []byte {
+	mac := hmac.New(sha256.New, t.Key)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)[:16]
+}
+
+// Decode returns the tracking data carried by the id part of a link, or nil if it isn't valid
+func (t *Tracker) Decode(id string) *TrackingData {
+	if t.Key != nil {
+		i := strings.LastIndexByte(id, '.')
+		if i < 0 {
+			return nil
+		}
+		sig, err := base64.RawURLEncoding.Strict().DecodeString(id[i+1:]) // strict, so a link has only one valid encoding
+		if err != nil || !hmac.Equal(sig, t.sign(id[:i])) {
+			return nil
+		}
+		id = id[:i]
+	}
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil
+	}
+	var d TrackingData
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil
+	}
+	return &d
+}
+
+// TrackingEvent is an open or click, as recorded by the tracking handler
+type TrackingEvent struct {
+	Type       string    `json:"type"` // TrackOpen or TrackClick
+	MessageID  string    `json:"msg_id"`
+	Rcpt       string    `json:"rcpt,omitempty"`
+	TargetURL  string    `json:"target_link_url,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"ip_address,omitempty"`
+	Time       time.Time `json:"timestamp"`
+}
+
+// TrackingSink receives the events recorded by the tracking handler. It's called from the HTTP request, so should
+// not block for long.
+type TrackingSink interface {
+	Track(ev *TrackingEvent)
+}
+
+// TrackingSinkFunc allows an ordinary function to be used as a TrackingSink
+type TrackingSinkFunc func(ev *TrackingEvent)
+
+// Track calls f(ev)
+func (f TrackingSinkFunc) Track(ev *TrackingEvent) {
+	f(ev)
+}
+
+// transparentGIF is a 1x1 pixel image, returned for opens
+var transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff!\xf9\x04\x01\x00\x00\x00\x00" +
+	",\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// Handler returns an HTTP handler for tracking links. Opens are answered with a transparent pixel, and clicks
+// redirected to the original link. Each is passed to sink, if not nil. Links that aren't valid get 404 Not Found.
+// Without a Key, anyone could make a link to anywhere, so clicks are recorded but answered 403 Forbidden rather
+// than redirected.
+func (t *Tracker) Handler(sink TrackingSink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The path ends /action/id, after whatever prefix URL has
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+		action, id := parts[len(parts)-2], parts[len(parts)-1]
+		d := t.Decode(id)
+		if d == nil || d.Action != action || (action != TrackOpen && action != TrackClick) {
+			http.NotFound(w, r)
+			return
+		}
+		if sink != nil {
+			addr, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				addr = r.RemoteAddr
+			}
+			sink.Track(&TrackingEvent{
+				Type:       action,
+				MessageID:  d.MessageID,
+				Rcpt:       d.Rcpt,
+				TargetURL:  d.TargetURL,
+				UserAgent:  r.UserAgent(),
+				RemoteAddr: addr,
+				Time:       time.Now(),
+			})
+		}
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		if action == TrackClick {
+			if t.Key == nil {
+				http.Error(w, "Unsigned tracking links are not redirected", http.StatusForbidden)
+				return
+			}
+			http.Redirect(w, r, d.TargetURL, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(transparentGIF)
+	})
+}
@@ -0,0 +1,151 @@
+package smtpproxy_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image/gif"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := smtpproxy.NewTracker("https://track.example.com/t/", []byte("secret"))
+	env := &smtpproxy.Envelope{MailFrom: "sender@example.com", RcptTo: []string{"rcpt@example.com"}}
+	URL1, URL2 := RandomURLWithPath(), RandomURLWithPath()
+	msg := "Message-ID: <abc123@example.com>\n" + fmt.Sprintf(testEmailTemplate, "rcpt@example.com", "sender@example.com",
+		"bound", "bound", testTextTemplate1, "bound", testHTML(testHTMLTemplate1, URL1, URL2), "bound")
+	out, err := smtpproxy.FilterMessage(env, strings.NewReader(msg), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := func(d *smtpproxy.TrackingData) string {
+		d.MessageID, d.Rcpt = "abc123@example.com", "rcpt@example.com"
+		return html.EscapeString(tracker.Link(d))
+	}
+	pixel := `<img src="` + link(&smtpproxy.TrackingData{Action: smtpproxy.TrackOpen}) + `" width="1" height="1" border="0" alt="">`
+	expected := "Message-ID: <abc123@example.com>\n" + fmt.Sprintf(testEmailTemplate, "rcpt@example.com", "sender@example.com",
+		"bound", "bound", testTextTemplate1, "bound",
+		fmt.Sprintf(testHTMLTemplate1, "",
+			link(&smtpproxy.TrackingData{Action: smtpproxy.TrackClick, TargetURL: URL1}),
+			link(&smtpproxy.TrackingData{Action: smtpproxy.TrackClick, TargetURL: URL2}),
+			pixel),
+		"bound")
+	if out.String() != expected {
+		t.Errorf("Got %q, expected %q", out.String(), expected)
+	}
+
+	// Encoded parts are tracked too, and links already tracked, or not http(s), are left alone
+	doc := `<a href='https://example.com/?a=1&amp;b=2'>x</a> <A HREF="mailto:me@example.com">y</A>`
+	tracked := tracker.TrackHTML(doc, "id", "")
+	if strings.Count(tracked, "https://track.example.com/t/click/") != 1 || !strings.Contains(tracked, "mailto:me@example.com") ||
+		!strings.HasSuffix(tracked, `alt="">`) {
+		t.Errorf("Got %q", tracked)
+	}
+	if again := tracker.TrackHTML(tracked, "id", ""); strings.Count(again, "/click/") != 1 {
+		t.Errorf("Link tracked twice: %q", again)
+	}
+	for _, cte := range []string{"base64", "quoted-printable"} {
+		var content string
+		if cte == "base64" {
+			content = encodeBase64(doc)
+		} else {
+			content = encodeQP(doc)
+		}
+		msg := "Content-Type: text/html\r\nContent-Transfer-Encoding: " + cte + "\r\n\r\n" + content + "\r\n"
+		out, err := smtpproxy.FilterMessage(&smtpproxy.Envelope{}, strings.NewReader(msg), tracker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := mail.ReadMessage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body []byte
+		if cte == "base64" {
+			body, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, m.Body))
+		} else {
+			body, err = ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), "https://track.example.com/t/click/") || !strings.Contains(string(body), "/open/") {
+			t.Errorf("%s: got %q", cte, body)
+		}
+	}
+}
+
+func TestTrackingHandler(t *testing.T) {
+	tracker := smtpproxy.NewTracker("http://track.example.com", []byte("secret"))
+	var events []*smtpproxy.TrackingEvent
+	handler := tracker.Handler(smtpproxy.TrackingSinkFunc(func(ev *smtpproxy.TrackingEvent) {
+		events = append(events, ev)
+	}))
+	get := func(link string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", link, nil)
+		req.Header.Set("User-Agent", "test agent")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	target := RandomURLWithPath()
+	click := tracker.Link(&smtpproxy.TrackingData{Action: smtpproxy.TrackClick, TargetURL: target, MessageID: "m1", Rcpt: "r@example.com"})
+	w := get(click)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != target {
+		t.Errorf("Click got %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	open := tracker.Link(&smtpproxy.TrackingData{Action: smtpproxy.TrackOpen, MessageID: "m1"})
+	w = get(open)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+		t.Errorf("Open got %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if img, err := gif.Decode(w.Body); err != nil || img.Bounds().Dx() != 1 || img.Bounds().Dy() != 1 {
+		t.Errorf("Open didn't return a 1x1 image: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != smtpproxy.TrackClick || events[0].TargetURL != target ||
+		events[0].MessageID != "m1" || events[0].Rcpt != "r@example.com" || events[0].UserAgent != "test agent" ||
+		events[1].Type != smtpproxy.TrackOpen {
+		t.Errorf("Got events %+v", events)
+	}
+
+	// Tampered, unsigned and mismatched links are refused, and not recorded
+	other := smtpproxy.NewTracker("http://track.example.com", nil)
+	i := strings.LastIndexByte(click, '.') + 1 // the start of the signature
+	tampered := click[:i] + "A" + click[i+1:]
+	if tampered == click {
+		tampered = click[:i] + "B" + click[i+1:]
+	}
+	for _, link := range []string{
+		tampered,
+		other.Link(&smtpproxy.TrackingData{Action: smtpproxy.TrackClick, TargetURL: "http://evil.example.com", MessageID: "m1"}),
+		strings.Replace(click, "/click/", "/open/", 1),
+		"http://track.example.com/",
+	} {
+		if w := get(link); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d", link, w.Code)
+		}
+	}
+	if len(events) != 2 {
+		t.Errorf("Got events %+v", events)
+	}
+
+	// Without a key, clicks are recorded but not redirected, as anyone could make the link
+	events = nil
+	handler = other.Handler(smtpproxy.TrackingSinkFunc(func(ev *smtpproxy.TrackingEvent) {
+		events = append(events, ev)
+	}))
+	w = get(other.Link(&smtpproxy.TrackingData{Action: smtpproxy.TrackClick, TargetURL: "http://evil.example.com", MessageID: "m1"}))
+	if w.Code != http.StatusForbidden || w.Header().Get("Location") != "" || len(events) != 1 {
+		t.Errorf("Unsigned click got %d, Location %q, events %+v", w.Code, w.Header().Get("Location"), events)
+	}
+}
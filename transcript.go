@@ -0,0 +1,336 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the transcripts recorded of each session, covering both the client and upstream connections.
+
+// Directions of the lines in a transcript
+const (
+	ClientToProxy   = "C->P"
+	ProxyToClient   = "P->C"
+	ProxyToUpstream = "P->U"
+	UpstreamToProxy = "U->P"
+	TranscriptNote  = "---" // something the proxy noted, such as a new upstream connection
+)
+
+// TranscriptRecorder records a transcript of each session, given to the Server. Each line sent or received, on
+// the client and upstream connections, is timestamped and tagged with its direction. AUTH exchanges are redacted.
+// Transcripts are held in memory until the session ends, so set MaxData if messages may be large.
+type TranscriptRecorder struct {
+	Sink    TranscriptSink // receives each transcript
+	MaxData int            // if > 0, bytes of each message recorded. The rest is counted, but left out
+}
+
+// TranscriptSink receives the transcript of each session once it ends
+type TranscriptSink interface {
+	WriteTranscript(sessionID string, transcript []byte) error
+}
+
+// TranscriptSinkFunc allows an ordinary function to be used as a TranscriptSink
+type TranscriptSinkFunc func(sessionID string, transcript []byte) error
+
+// WriteTranscript calls f(sessionID, transcript)
+func (f TranscriptSinkFunc) WriteTranscript(sessionID string, transcript []byte) error {
+	return f(sessionID, transcript)
+}
+
+// TranscriptDir is a TranscriptSink that writes each transcript to a file in a directory, named for the session
+type TranscriptDir struct {
+	dir string
+}
+
+// NewTranscriptDir returns a TranscriptSink writing to dir, which is created if need be
+func NewTranscriptDir(dir string) (*TranscriptDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &TranscriptDir{dir: dir}, nil
+}
+
+// WriteTranscript writes the transcript to sessionID.log
+func (d *TranscriptDir) WriteTranscript(sessionID string, transcript []byte) error {
+	return ioutil.WriteFile(filepath.Join(d.dir, sessionID+".log"), transcript, 0600)
+}
+
+// Transcript is the record of one session, built up as it goes
+type Transcript struct {
+	maxData  int
+	locker   sync.Mutex
+	buf      bytes.Buffer
+	client   *transcriptLeg
+	upstream *transcriptLeg
+}
+
+func newTranscript(maxData int) *Transcript {
+	t := &Transcript{maxData: maxData}
+	t.client = newTranscriptLeg(t, ClientToProxy, ProxyToClient)
+	t.upstream = newTranscriptLeg(t, ProxyToUpstream, UpstreamToProxy)
+	return t
+}
+
+// Bytes returns the transcript so far
+func (t *Transcript) Bytes() []byte {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return append([]byte(nil), t.buf.Bytes()...)
+}
+
+// note records something the proxy noted. It does nothing on a nil *Transcript.
+func (t *Transcript) note(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.record(TranscriptNote, fmt.Sprintf(format, args...))
+}
+
+// record a line, without its line ending. The caller holds the lock.
+func (t *Transcript) record(dir, line string) {
+	fmt.Fprintf(&t.buf, "%s %s %s\n", time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), dir, line)
+}
+
+type transcriptContextKey struct{}
+
+// withTranscript returns a context carrying t, so the backend can add the upstream connection to it
+func withTranscript(ctx context.Context, t *Transcript) context.Context {
+	return context.WithValue(ctx, transcriptContextKey{}, t)
+}
+
+// transcriptFrom returns the transcript carried by ctx, or nil
+func transcriptFrom(ctx context.Context) *Transcript {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(transcriptContextKey{}).(*Transcript)
+	return t
+}
+
+// maxTranscriptLine is the longest line recorded as one. Longer lines, such as binary BDAT data, are split.
+const maxTranscriptLine = 1000
+
+// transcriptLeg follows the commands and responses on one connection, so that AUTH exchanges can be redacted and
+// message data told apart from commands
+type transcriptLeg struct {
+	t           *Transcript
+	cmds, resps *transcriptStream
+	pending     []string // commands awaiting a response, for those that matter
+	payloadNext bool     // the next line is an AUTH payload
+	inData      bool     // message data is being sent, ending with "."
+	chunkLeft   int64    // BDAT data yet to come
+	chunkLast   bool     // the BDAT chunk is the last of the message
+	dataBytes   int      // of the current message
+	skipped     int      // bytes of message data left out, since the last note of them
+}
+
+func newTranscriptLeg(t *Transcript, cmdDir, respDir string) *transcriptLeg {
+	l := &transcriptLeg{t: t}
+	l.cmds = &transcriptStream{leg: l, dir: cmdDir, cmd: true}
+	l.resps = &transcriptStream{leg: l, dir: respDir}
+	return l
+}
+
+// reset forgets the state of the last connection, when a new one joins the transcript
+func (l *transcriptLeg) reset() {
+	l.t.locker.Lock()
+	defer l.t.locker.Unlock()
+	l.cmds.buf, l.resps.buf = nil, nil
+	l.pending = nil
+	l.payloadNext, l.inData = false, false
+	l.chunkLeft, l.chunkLast = 0, false
+	l.dataBytes, l.skipped = 0, 0
+}
+
+// command records a line sent by the client side of the connection
+func (l *transcriptLeg) command(dir, line string) {
+	switch {
+	case l.inData:
+		if line == "." {
+			l.endData(dir)
+			l.inData = false
+			l.dataBytes = 0
+			l.t.record(dir, line)
+			return
+		}
+		l.data(dir, line)
+		return
+	case l.payloadNext:
+		l.payloadNext = false
+		l.pending = append(l.pending, "AUTH")
+		l.t.record(dir, "[redacted]")
+		return
+	}
+	fields := strings.Fields(line)
+	verb := ""
+	if len(fields) > 0 {
+		verb = strings.ToUpper(fields[0])
+	}
+	switch verb {
+	case "AUTH":
+		if len(fields) > 2 {
+			line = fields[0] + " " + fields[1] + " [redacted]"
+		}
+		l.pending = append(l.pending, verb)
+	case "DATA":
+		l.pending = append(l.pending, verb)
+	case "BDAT":
+		if len(fields) > 1 {
+			if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil && size > 0 {
+				l.chunkLeft = size
+				l.chunkLast = len(fields) > 2 && strings.EqualFold(fields[2], "LAST")
+			}
+		}
+		l.pending = append(l.pending, "")
+	default:
+		l.pending = append(l.pending, "")
+	}
+	l.t.record(dir, line)
+}
+
+// response records a line sent by the server side of the connection
+func (l *transcriptLeg) response(dir, line string) {
+	l.t.record(dir, line)
+	if len(line) > 3 && line[3] == '-' {
+		return // more lines to come
+	}
+	if len(l.pending) == 0 {
+		return // a greeting, or more LMTP responses
+	}
+	cmd := l.pending[0]
+	l.pending = l.pending[1:]
+	code := line
+	if len(code) > 3 {
+		code = code[:3]
+	}
+	switch {
+	case cmd == "AUTH" && code == "334":
+		l.payloadNext = true
+	case cmd == "DATA" && code == "354":
+		l.inData = true
+		l.dataBytes = 0
+	}
+}
+
+// data records a line of message data, unless the message is over the limit
+func (l *transcriptLeg) data(dir, line string) {
+	l.dataBytes += len(line)
+	if l.t.maxData > 0 && l.dataBytes > l.t.maxData {
+		l.skipped += len(line)
+		return
+	}
+	l.t.record(dir, line)
+}
+
+// endData notes any message data left out
+func (l *transcriptLeg) endData(dir string) {
+	if l.skipped > 0 {
+		l.t.record(dir, fmt.Sprintf("[%d bytes of message data not recorded]", l.skipped))
+		l.skipped = 0
+	}
+}
+
+// transcriptStream gathers the bytes sent one way on a connection into lines, for the transcript
+type transcriptStream struct {
+	leg *transcriptLeg
+	dir string
+	cmd bool   // sent by the client side
+	buf []byte // partial line
+}
+
+// Write is always successful, so as not to disturb the connection
+func (s *transcriptStream) Write(p []byte) (int, error) {
+	l := s.leg
+	l.t.locker.Lock()
+	defer l.t.locker.Unlock()
+	s.buf = append(s.buf, p...)
+	start := 0
+	for start < len(s.buf) {
+		rest := s.buf[start:]
+		if s.cmd && l.chunkLeft > 0 {
+			// BDAT data is counted out, rather than ending with a line
+			n := len(rest)
+			if int64(n) > l.chunkLeft {
+				n = int(l.chunkLeft)
+			}
+			if i := bytes.IndexByte(rest[:n], '\n'); i >= 0 {
+				n = i + 1
+			} else if int64(n) < l.chunkLeft && n < maxTranscriptLine {
+				break // wait for the rest of the line
+			} else if n > maxTranscriptLine {
+				n = maxTranscriptLine
+			}
+			l.data(s.dir, strings.TrimRight(string(rest[:n]), "\r\n"))
+			l.chunkLeft -= int64(n)
+			start += n
+			if l.chunkLeft == 0 {
+				l.endData(s.dir)
+				if l.chunkLast {
+					l.dataBytes = 0
+				}
+			}
+			continue
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			if len(rest) < maxTranscriptLine {
+				break // wait for the rest of the line
+			}
+			i = maxTranscriptLine - 1
+		}
+		line := strings.TrimRight(string(rest[:i+1]), "\r\n")
+		start += i + 1
+		if s.cmd {
+			l.command(s.dir, line)
+		} else {
+			l.response(s.dir, line)
+		}
+	}
+	s.buf = s.buf[:copy(s.buf, s.buf[start:])]
+	return len(p), nil
+}
+
+// switchWriter passes writes on to w, which can be changed while in use. Writes always succeed.
+type switchWriter struct {
+	locker sync.Mutex
+	w      io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.w != nil {
+		s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s *switchWriter) set(w io.Writer) {
+	s.locker.Lock()
+	s.w = w
+	s.locker.Unlock()
+}
+
+// prefixLines returns b with prefix at the start of each line
+func prefixLines(b []byte, prefix string) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 {
+			out.WriteString(prefix)
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
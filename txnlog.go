@@ -0,0 +1,157 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// This file contains functions for logging a structured record of each transaction the proxy handles.
+
+// TransactionEvent records what happened to a transaction, from MAIL to the response to the message, or until it
+// was abandoned
+type TransactionEvent struct {
+	SessionID     string            `json:"session_id"`
+	TransactionID string            `json:"txn_id"`
+	ClientAddr    string            `json:"client_ip,omitempty"`
+	Helo          string            `json:"helo,omitempty"`
+	ClientTLS     string            `json:"client_tls,omitempty"` // TLS version on the client side, if used
+	Upstream      string            `json:"upstream,omitempty"`
+	UpstreamTLS   string            `json:"upstream_tls,omitempty"` // TLS version on the upstream side, if used
+	AuthUser      string            `json:"auth_user,omitempty"`    // when the proxy authenticates clients itself
+	MailFrom      string            `json:"mail_from"`
+	Recipients    []RecipientResult `json:"recipients"`
+	Command       string            `json:"command,omitempty"` // DATA or BDAT. Empty if no message was sent
+	Size          int64             `json:"size"`              // bytes of message received from the client
+	Code          int               `json:"code,omitempty"`    // response to the message
+	Msg           string            `json:"msg,omitempty"`
+	QueueID       string            `json:"queue_id,omitempty"` // parsed from the response, if given
+	Time          time.Time         `json:"time"`               // when MAIL was accepted
+	LatencyMS     int64             `json:"latency_ms"`         // from MAIL to the end of the transaction
+}
+
+// RecipientResult is a recipient of a transaction, and the response to its RCPT command
+type RecipientResult struct {
+	Address string `json:"address"`
+	Code    int    `json:"code"`
+	Msg     string `json:"msg,omitempty"`
+}
+
+// TransactionLogger receives a record of each transaction once it ends. It's called from the session, so should
+// not block for long.
+type TransactionLogger interface {
+	LogTransaction(ev *TransactionEvent)
+}
+
+// TransactionLoggerFunc allows an ordinary function to be used as a TransactionLogger
+type TransactionLoggerFunc func(ev *TransactionEvent)
+
+// LogTransaction calls f(ev)
+func (f TransactionLoggerFunc) LogTransaction(ev *TransactionEvent) {
+	f(ev)
+}
+
+// JSONLogger is a TransactionLogger that writes each event as a line of JSON
+type JSONLogger struct {
+	w      io.Writer
+	locker sync.Mutex
+}
+
+// NewJSONLogger returns a TransactionLogger writing JSON lines to w
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+// LogTransaction writes ev as one line. Write errors are ignored, as the proxy carries on regardless.
+func (l *JSONLogger) LogTransaction(ev *TransactionEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	l.w.Write(append(b, '\n'))
+}
+
+// queueIDRes find the ID an upstream gives a message in its response, for some well known servers
+var queueIDRes = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bqueued as:?\s+<?([A-Za-z0-9][\w.@/-]*)`),   // Postfix, and this proxy's queue
+	regexp.MustCompile(`(?i)\bid=<?([A-Za-z0-9][\w.@/-]*)`),              // Exim
+	regexp.MustCompile(`\b([A-Za-z0-9]+) Message accepted for delivery`), // Sendmail
+}
+
+// upstreamQueueID returns the ID given to a message in the response to it, or "" if there isn't one
+func upstreamQueueID(msg string) string {
+	for _, re := range queueIDRes {
+		if m := re.FindStringSubmatch(msg); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// tlsVersion returns the name of the TLS version of a connection, or "" if it isn't using TLS
+func tlsVersion(state tls.ConnectionState, isTLS bool) string {
+	if !isTLS || state.Version == 0 {
+		return ""
+	}
+	return tls.VersionName(state.Version)
+}
+
+//-----------------------------------------------------------------------------
+// Session side
+
+// txnMail starts the record of a transaction, once MAIL is accepted
+func (s *proxySession) txnMail(arg string) {
+	if s.bkd.txnLogger == nil {
+		return
+	}
+	if s.txn != nil {
+		s.txnLog() // MAIL again, without the last transaction having ended
+	}
+	from, _ := parsePath(arg, "FROM:")
+	s.txn = &TransactionEvent{TransactionID: s.txnID, MailFrom: from, Recipients: []RecipientResult{}, Time: time.Now()}
+}
+
+// txnRcpt records the response to a recipient
+func (s *proxySession) txnRcpt(arg string, code int, msg string) {
+	if s.txn == nil {
+		return
+	}
+	rcpt, _ := parsePath(arg, "TO:")
+	s.txn.Recipients = append(s.txn.Recipients, RecipientResult{Address: rcpt, Code: code, Msg: msg})
+}
+
+// txnResult records the response to the message, of size bytes more than any already counted
+func (s *proxySession) txnResult(cmd string, size int64, code int, msg string, err error) {
+	if s.txn == nil || s.txn.Command != "" {
+		return
+	}
+	if code == 0 && err != nil {
+		code, msg = 599, err.Error()
+	}
+	s.txn.Command, s.txn.Code, s.txn.Msg = cmd, code, msg
+	s.txn.Size += size
+	s.txn.QueueID = upstreamQueueID(msg)
+}
+
+// txnLog completes the record of the transaction and passes it to the logger
+func (s *proxySession) txnLog() {
+	ev := s.txn
+	s.txn = nil
+	ev.SessionID = s.id
+	ev.ClientAddr = s.clientAddr
+	ev.Helo = s.state.Hostname
+	ev.ClientTLS = tlsVersion(s.state.TLS, s.state.TLS.HandshakeComplete)
+	ev.Upstream = s.addr
+	if s.upstream != nil {
+		ev.UpstreamTLS = tlsVersion(s.upstream.TLSConnectionState())
+	}
+	ev.AuthUser = s.authUser
+	ev.LatencyMS = time.Since(ev.Time).Milliseconds()
+	s.bkd.txnLogger.LogTransaction(ev)
+}
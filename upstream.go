@@ -0,0 +1,156 @@
+// Package smtpproxy is based heavily on https://github.com/emersion/go-smtp, with increased transparency of response codes and no sasl dependency.
+package smtpproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains functions for the proxy to fail over between several upstream servers.
+
+// Upstream is a server the proxy can relay to
+type Upstream struct {
+	HostPort string
+	Priority int // lower values are tried first, as with MX preference
+	Weight   int // share of sessions among upstreams of equal priority. Zero counts as 1
+}
+
+// DefaultRetryAfter is how long an UpstreamPool avoids an upstream after it fails
+const DefaultRetryAfter = 30 * time.Second
+
+// UpstreamPool holds a set of upstream servers, tracking which are healthy. An upstream is marked down when
+// a connection to it fails, and is then tried only as a last resort until RetryAfter has passed.
+type UpstreamPool struct {
+	RetryAfter time.Duration
+
+	upstreams []Upstream
+	locker    sync.Mutex
+	downUntil map[string]time.Time
+	rnd       *rand.Rand // guarded by locker
+}
+
+// NewUpstreamPool creates a pool of the given upstreams, all initially healthy
+func NewUpstreamPool(upstreams []Upstream) *UpstreamPool {
+	p := &UpstreamPool{
+		RetryAfter: DefaultRetryAfter,
+		upstreams:  make([]Upstream, len(upstreams)),
+		downUntil:  make(map[string]time.Time),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	copy(p.upstreams, upstreams)
+	sort.SliceStable(p.upstreams, func(i, j int) bool {
+		return p.upstreams[i].Priority < p.upstreams[j].Priority
+	})
+	return p
+}
+
+// Order returns the upstream host:ports in the order they should be tried for a new session. Healthy upstreams
+// come first, by priority, shuffled according to weight within each priority. Upstreams marked down follow.
+func (p *UpstreamPool) Order() []string {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	now := time.Now()
+	var healthy, down []string
+	for i := 0; i < len(p.upstreams); {
+		// Find the run of upstreams with this priority, and pick from it by weight
+		j := i
+		for j < len(p.upstreams) && p.upstreams[j].Priority == p.upstreams[i].Priority {
+			j++
+		}
+		for _, u := range p.weightedShuffle(p.upstreams[i:j]) {
+			if now.Before(p.downUntil[u.HostPort]) {
+				down = append(down, u.HostPort)
+			} else {
+				healthy = append(healthy, u.HostPort)
+			}
+		}
+		i = j
+	}
+	return append(healthy, down...)
+}
+
+// weightedShuffle returns upstreams in a random order, where those with more weight tend to come earlier
+func (p *UpstreamPool) weightedShuffle(upstreams []Upstream) []Upstream {
+	remaining := make([]Upstream, len(upstreams))
+	copy(remaining, upstreams)
+	out := make([]Upstream, 0, len(upstreams))
+	for len(remaining) > 0 {
+		total := 0
+		for _, u := range remaining {
+			total += weight(u)
+		}
+		n := p.rnd.Intn(total)
+		i := 0
+		for ; n >= weight(remaining[i]); i++ {
+			n -= weight(remaining[i])
+		}
+		out = append(out, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return out
+}
+
+func weight(u Upstream) int {
+	if u.Weight < 1 {
+		return 1
+	}
+	return u.Weight
+}
+
+// MarkDown records that an upstream has failed
+func (p *UpstreamPool) MarkDown(hostPort string) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.downUntil[hostPort] = time.Now().Add(p.RetryAfter)
+}
+
+// MarkUp records that an upstream is working
+func (p *UpstreamPool) MarkUp(hostPort string) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	delete(p.downUntil, hostPort)
+}
+
+// Healthy reports whether an upstream is not currently marked down
+func (p *UpstreamPool) Healthy(hostPort string) bool {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	return !time.Now().Before(p.downUntil[hostPort])
+}
+
+// ParseUpstreams reads a comma-separated list of upstreams, each given as host:port[/priority[/weight]], e.g.
+// "primary.example.com:587,backup.example.com:587". Where the priority is omitted, it is the upstream's position
+// in the list, so by default later upstreams are backups for earlier ones. Unix socket paths take no options.
+func ParseUpstreams(s string) ([]Upstream, error) {
+	var upstreams []Upstream
+	for i, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "/") {
+			upstreams = append(upstreams, Upstream{HostPort: item, Priority: i}) // Unix socket path
+			continue
+		}
+		fields := strings.Split(item, "/")
+		if fields[0] == "" || len(fields) > 3 {
+			return nil, fmt.Errorf("upstream %q: expected host:port[/priority[/weight]]", item)
+		}
+		u := Upstream{HostPort: fields[0], Priority: i}
+		var err error
+		if len(fields) > 1 {
+			if u.Priority, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("upstream %q: invalid priority", item)
+			}
+		}
+		if len(fields) > 2 {
+			if u.Weight, err = strconv.Atoi(fields[2]); err != nil || u.Weight < 0 {
+				return nil, fmt.Errorf("upstream %q: invalid weight", item)
+			}
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
@@ -0,0 +1,73 @@
+package smtpproxy_test
+
+import (
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := smtpproxy.ParseUpstreams("a.example:587, b.example:587/5/3,/run/lmtp.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []smtpproxy.Upstream{
+		{HostPort: "a.example:587", Priority: 0},
+		{HostPort: "b.example:587", Priority: 5, Weight: 3},
+		{HostPort: "/run/lmtp.sock", Priority: 2},
+	}
+	if len(upstreams) != len(expected) {
+		t.Fatalf("Got %v, expected %v", upstreams, expected)
+	}
+	for i := range expected {
+		if upstreams[i] != expected[i] {
+			t.Errorf("Got %v, expected %v", upstreams[i], expected[i])
+		}
+	}
+
+	for _, bad := range []string{"", "a.example:587,", "a.example:587/x", "a.example:587/1/-1", "a.example:587/1/2/3"} {
+		if _, err := smtpproxy.ParseUpstreams(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpstreamPool(t *testing.T) {
+	pool := smtpproxy.NewUpstreamPool([]smtpproxy.Upstream{
+		{HostPort: "backup:25", Priority: 20},
+		{HostPort: "heavy:25", Priority: 10, Weight: 99},
+		{HostPort: "light:25", Priority: 10, Weight: 1},
+	})
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		order := pool.Order()
+		if len(order) != 3 || order[2] != "backup:25" {
+			t.Fatalf("Unexpected order %v", order)
+		}
+		if order[0] == "heavy:25" {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 80 {
+		t.Errorf("Weight 99 upstream was first only %d times in 100", heavyFirst)
+	}
+
+	// Upstreams marked down are tried last, until they recover
+	pool.MarkDown("heavy:25")
+	pool.MarkDown("light:25")
+	if pool.Healthy("light:25") || !pool.Healthy("backup:25") {
+		t.Error("Unexpected health")
+	}
+	if order := pool.Order(); order[0] != "backup:25" {
+		t.Errorf("Unexpected order %v", order)
+	}
+	pool.MarkUp("light:25")
+	if order := pool.Order(); order[0] != "light:25" || order[2] != "heavy:25" {
+		t.Errorf("Unexpected order %v", order)
+	}
+	pool.RetryAfter = 0
+	pool.MarkDown("light:25")
+	if !pool.Healthy("light:25") {
+		t.Error("Expected upstream to recover once RetryAfter has passed")
+	}
+}